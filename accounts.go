@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+
+	"GoTalk/nc"
+)
+
+// One account monitored on an organization instance.
+// The primary account has no name: its user settings and cache keep using the instance name.
+type accountRef struct {
+	instance string // Key of the instance in OrgSettings.InstanceData
+	account  string // Name given by the user to an additional account, empty for the primary one
+}
+
+// Key of the account in the user settings and in the cache.
+// It also names the account in the tray and in its notifications.
+func (a accountRef) key() string {
+	if a.account == "" {
+		return a.instance
+	}
+	return a.instance + " (" + a.account + ")"
+}
+
+// Lists the accounts of every instance, sorted by instance, each primary account first.
+// The instances of the organization come before the ones added by the user.
+func configuredAccounts() []accountRef {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return configuredAccountsLocked()
+}
+
+func configuredAccountsLocked() []accountRef {
+	instances := make([]string, 0, len(org.InstanceData))
+	for k := range org.InstanceData {
+		instances = append(instances, k)
+	}
+	sort.Strings(instances)
+
+	added := make([]string, 0, len(user.UserInstances))
+	for k := range user.UserInstances {
+		if _, ok := org.InstanceData[k]; ok {
+			continue
+		}
+		if _, ok := instanceSettingsLocked(k); ok {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	instances = append(instances, added...)
+
+	var accounts []accountRef
+	for _, instance := range instances {
+		accounts = append(accounts, instanceAccountsLocked(instance)...)
+	}
+	return accounts
+}
+
+func instanceAccountsLocked(instance string) []accountRef {
+	accounts := []accountRef{{instance: instance}}
+	for _, name := range user.InstanceData[instance].Accounts {
+		accounts = append(accounts, accountRef{instance: instance, account: name})
+	}
+	return accounts
+}
+
+// Whether notifications of this instance must tell which account they come from.
+func hasSeveralAccounts(instance string) bool {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return len(user.InstanceData[instance].Accounts) > 0
+}
+
+// Creates the user settings and the cache of an account, if it has none yet.
+// The caller holds settingsMutex.
+func initAccountSettings(ref accountRef) {
+	if _, ok := user.InstanceData[ref.key()]; !ok {
+		// Sensible default user settings for a new account
+		user.InstanceData[ref.key()] = UserInstanceSettings{
+			NotificationSettings: nc.DefaultNotificationSettings(),
+		}
+	}
+
+	if _, ok := cache.InstanceData[ref.key()]; !ok {
+		cache.InstanceData[ref.key()] = InstanceCache{}
+	}
+}
+
+// Adds an account to an instance and saves it in the user settings.
+func addAccount(instance string, name string) (accountRef, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return accountRef{}, errors.New("the account needs a name")
+	}
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	data := user.InstanceData[instance]
+	if slices.Contains(data.Accounts, name) {
+		return accountRef{}, errors.New("this instance already has an account named " + name)
+	}
+
+	ref := accountRef{instance: instance, account: name}
+	if _, ok := instanceSettingsLocked(ref.key()); ok {
+		// The key would clash with the settings of another instance.
+		return accountRef{}, errors.New("an instance is already named " + ref.key())
+	}
+
+	data.Accounts = append(data.Accounts, name)
+	user.InstanceData[instance] = data
+	initAccountSettings(ref)
+
+	if err := settingsManager.Save(cache, user, org); err != nil {
+		return accountRef{}, err
+	}
+	return ref, nil
+}
+
+// Finds another account of the same instance logged in as the given user.
+func duplicateLogin(ref accountRef, loginName string) (accountRef, bool) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	for _, other := range instanceAccountsLocked(ref.instance) {
+		if other != ref && loginName != "" && strings.EqualFold(cache.InstanceData[other.key()].Username, loginName) {
+			return other, true
+		}
+	}
+	return accountRef{}, false
+}
+
+func duplicateLoginMessage(loginName string, other accountRef) string {
+	return loginName + " is already monitored as " + other.key() + ". " +
+		"The login grants access to whoever is signed in to Nextcloud in the browser: sign out there first, " +
+		"or open the login link in a private window, e.g. from \"GoTalk login\"."
+}
+
+// Forgets an additional account: its name, its user settings and its cache.
+func removeAccount(ref accountRef) error {
+	if ref.account == "" {
+		return errors.New("the primary account of " + ref.instance + " can't be removed")
+	}
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	data := user.InstanceData[ref.instance]
+	data.Accounts = slices.DeleteFunc(slices.Clone(data.Accounts), func(name string) bool { return name == ref.account })
+	user.InstanceData[ref.instance] = data
+	delete(user.InstanceData, ref.key())
+	delete(cache.InstanceData, ref.key())
+
+	return settingsManager.Save(cache, user, org)
+}
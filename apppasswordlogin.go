@@ -0,0 +1,133 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"context"
+	osuser "os/user"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Asks for a user name and an app password, for machines without a usable browser.
+// No login flow is involved: the credentials are checked against the server right away.
+type appPasswordLogin struct{}
+
+func (appPasswordLogin) WaitsForUser() bool { return false }
+
+// The name of the OS account, without its domain.
+func osUsername() string {
+	u, err := osuser.Current()
+	if err != nil {
+		return ""
+	}
+	name := u.Username
+	if idx := strings.LastIndexAny(name, `\/`); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
+}
+
+func (appPasswordLogin) login(ctx context.Context, p *monitorProcData) (chan loginFlowOutcome, error) {
+	chanLoginFlow := make(chan loginFlowOutcome, 1)
+	var once sync.Once
+	finish := func(outcome loginFlowOutcome) {
+		once.Do(func() {
+			chanLoginFlow <- outcome
+			close(chanLoginFlow)
+		})
+	}
+
+	window := fyne.CurrentApp().NewWindow(p.accountKey + " - Log In")
+	done := make(chan struct{})
+
+	username := widget.NewEntry()
+	username.SetText(p.cache.Username)
+	// Additional accounts are rarely named after the OS account.
+	if username.Text == "" && p.org.PrefillUsername && p.account.account == "" {
+		username.SetText(osUsername())
+	}
+
+	password := widget.NewPasswordEntry()
+	password.SetPlaceHolder("xxxxx-xxxxx-xxxxx-xxxxx-xxxxx")
+
+	hint := widget.NewLabel("Create an app password in the Nextcloud security settings, then enter it here.")
+	hint.Wrapping = fyne.TextWrapWord
+
+	status := widget.NewLabel("")
+	status.Wrapping = fyne.TextWrapWord
+
+	var form *widget.Form
+	form = &widget.Form{
+		Items: []*widget.FormItem{
+			widget.NewFormItem("User name", username),
+			widget.NewFormItem("App password", password),
+		},
+		SubmitText: "Log In",
+		CancelText: "Cancel",
+		OnCancel:   window.Close,
+		OnSubmit: func() {
+			credentials := nc.AuthCredentials{
+				LoginName:   strings.TrimSpace(username.Text),
+				AppPassword: strings.TrimSpace(password.Text),
+			}
+			if credentials.LoginName == "" || credentials.AppPassword == "" {
+				status.SetText("Enter both the user name and the app password.")
+				return
+			}
+			if other, ok := duplicateLogin(p.account, credentials.LoginName); ok {
+				status.SetText(credentials.LoginName + " is already monitored as " + other.key() + ".")
+				return
+			}
+
+			form.Disable()
+			status.SetText("Checking…")
+
+			go func() {
+				defer form.Enable()
+
+				result, err := p.ncInstance.ValidateCredentials(ctx, credentials)
+				switch {
+				case err != nil:
+					status.SetText("Could not check the credentials: " + err.Error())
+				case result != nc.CredentialsValid:
+					status.SetText("Wrong user name or app password.")
+				default:
+					// Stored through the regular credentials update, once the monitor receives them.
+					finish(loginFlowOutcome{LoginFlowSuccessful, credentials})
+					window.Close()
+				}
+			}()
+		},
+	}
+
+	window.SetContent(container.NewVBox(hint, form, status))
+	window.Resize(fyne.NewSize(420, 0))
+	window.CenterOnScreen()
+	window.SetOnClosed(func() {
+		close(done)
+
+		// The user dismissed the prompt: don't show it again right away.
+		once.Do(func() {
+			p.loggedOut = true
+			chanLoginFlow <- loginFlowOutcome{LoginFlowCanceled, nc.AuthCredentials{}}
+			close(chanLoginFlow)
+		})
+	})
+	window.Show()
+	window.RequestFocus()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// The app is quitting.
+			window.Close()
+		case <-done:
+		}
+	}()
+
+	return chanLoginFlow, nil
+}
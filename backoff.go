@@ -0,0 +1,90 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"log"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+type backoffPolicy struct {
+	initial    time.Duration // Delay after the first failure
+	max        time.Duration // Upper bound for the delay
+	multiplier float64       // Growth factor after each consecutive failure
+	jitter     float64       // Random spread, as a fraction of the delay (0.2 = ±20%). Negative disables it.
+}
+
+func defaultBackoffPolicy() backoffPolicy {
+	return backoffPolicy{
+		initial:    time.Second * 10,
+		max:        time.Minute * 10,
+		multiplier: 2,
+		jitter:     0.2,
+	}
+}
+
+// Replaces missing or nonsensical values with their defaults.
+func (b backoffPolicy) withDefaults() backoffPolicy {
+	d := defaultBackoffPolicy()
+	if b.initial <= 0 {
+		b.initial = d.initial
+	}
+	if b.max <= 0 {
+		b.max = d.max
+	}
+	if b.max < b.initial {
+		b.max = b.initial
+	}
+	if b.multiplier < 1 {
+		b.multiplier = d.multiplier
+	}
+	if b.jitter < 0 {
+		b.jitter = 0
+	} else if b.jitter == 0 || b.jitter >= 1 {
+		b.jitter = d.jitter
+	}
+	return b
+}
+
+// Some errors need someone to fix the server or the account:
+// retrying them early is pointless, so their delay starts higher.
+func backoffFloor(kind nc.APIErrorKind) time.Duration {
+	switch kind {
+	case nc.ErrorMaintenance:
+		return time.Minute
+	case nc.ErrorCertificate:
+		return time.Minute * 5
+	case nc.ErrorForbidden, nc.ErrorNotFound:
+		return time.Minute * 15
+	}
+	return 0
+}
+
+// Spreads the delay so that every client doesn't retry in lockstep after an outage.
+func (b backoffPolicy) applyJitter(delay time.Duration) time.Duration {
+	if b.jitter == 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 + b.jitter*(rand.Float64()*2-1)))
+}
+
+// Returns how long to wait after the given number of consecutive failures, the last one being err.
+func (b backoffPolicy) delay(failures int, err error) time.Duration {
+	if apiErr, ok := nc.AsAPIError(err); ok && apiErr.RetryAfter > 0 {
+		// The server told us when to come back: don't come back earlier than that,
+		// unless it asks for longer than the backoff ever waits, e.g. a misconfigured proxy.
+		retryAfter := apiErr.RetryAfter
+		if retryAfter > b.max {
+			log.Printf("Retry-After of %s capped at %s", retryAfter, b.max)
+			retryAfter = b.max
+		}
+		return retryAfter + time.Duration(float64(retryAfter)*b.jitter*rand.Float64())
+	}
+
+	exponent := float64(max(failures-1, 0))
+	delay := time.Duration(math.Min(float64(b.initial)*math.Pow(b.multiplier, exponent), float64(b.max)))
+	delay = max(delay, min(backoffFloor(nc.ErrorKindOf(err)), b.max))
+
+	return b.applyJitter(delay)
+}
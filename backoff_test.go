@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"GoTalk/nc"
+)
+
+func TestBackoffWithDefaults(t *testing.T) {
+	d := defaultBackoffPolicy()
+
+	tests := []struct {
+		name   string
+		policy backoffPolicy
+		want   backoffPolicy
+	}{
+		{"zero values use the defaults", backoffPolicy{}, d},
+		{"negative values use the defaults", backoffPolicy{initial: -1, max: -1, multiplier: -1}, d},
+		{"negative jitter disables it", backoffPolicy{initial: time.Second, max: time.Minute, multiplier: 3, jitter: -1}, backoffPolicy{initial: time.Second, max: time.Minute, multiplier: 3, jitter: 0}},
+		{"jitter of 1 or more uses the default", backoffPolicy{initial: time.Second, max: time.Minute, multiplier: 3, jitter: 1}, backoffPolicy{initial: time.Second, max: time.Minute, multiplier: 3, jitter: d.jitter}},
+		{"max below initial is raised", backoffPolicy{initial: time.Minute, max: time.Second, multiplier: 2, jitter: 0.1}, backoffPolicy{initial: time.Minute, max: time.Minute, multiplier: 2, jitter: 0.1}},
+		{"valid values are kept", backoffPolicy{initial: time.Second, max: time.Hour, multiplier: 1.5, jitter: 0.5}, backoffPolicy{initial: time.Second, max: time.Hour, multiplier: 1.5, jitter: 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.withDefaults(); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Every delay stays within the jitter of the exponential curve, capped at max.
+func TestBackoffDelay(t *testing.T) {
+	b := backoffPolicy{initial: time.Second * 10, max: time.Minute * 10, multiplier: 2, jitter: 0.2}
+	network := errors.New("connection refused")
+
+	tests := []struct {
+		failures int
+		err      error
+		want     time.Duration
+	}{
+		{1, network, time.Second * 10},
+		{2, network, time.Second * 20},
+		{4, network, time.Second * 80},
+		{20, network, time.Minute * 10},
+		// Errors that need someone to fix the server start higher.
+		{1, &nc.APIError{Kind: nc.ErrorMaintenance}, time.Minute},
+		{1, &nc.APIError{Kind: nc.ErrorForbidden}, time.Minute * 10},
+	}
+	for _, tt := range tests {
+		for range 50 {
+			got := b.delay(tt.failures, tt.err)
+			low := time.Duration(float64(tt.want) * (1 - b.jitter))
+			high := time.Duration(float64(tt.want) * (1 + b.jitter))
+			if got < low || got > high {
+				t.Fatalf("delay(%d, %v) = %s, want within %s and %s", tt.failures, tt.err, got, low, high)
+			}
+		}
+	}
+}
+
+// Without jitter, every delay follows the curve exactly.
+func TestBackoffWithoutJitter(t *testing.T) {
+	b := backoffPolicy{initial: time.Second * 10, max: time.Minute * 10, multiplier: 2, jitter: -1}.withDefaults()
+	for range 50 {
+		if got := b.delay(3, errors.New("connection refused")); got != time.Second*40 {
+			t.Fatalf("delay(3) = %s, want 40s", got)
+		}
+	}
+}
+
+// Retry-After is never undercut, but capped at the longest backoff.
+func TestBackoffRetryAfter(t *testing.T) {
+	b := backoffPolicy{initial: time.Second * 10, max: time.Minute * 10, multiplier: 2, jitter: 0.2}
+
+	tests := []struct {
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{time.Second * 30, time.Second * 30},
+		{time.Minute * 10, time.Minute * 10},
+		{time.Hour * 24, time.Minute * 10},
+	}
+	for _, tt := range tests {
+		err := &nc.APIError{Kind: nc.ErrorMaintenance, RetryAfter: tt.retryAfter}
+		for range 50 {
+			got := b.delay(1, err)
+			low := tt.want
+			high := time.Duration(float64(tt.want) * (1 + b.jitter))
+			if got < low || got > high {
+				t.Fatalf("delay with Retry-After %s = %s, want within %s and %s", tt.retryAfter, got, low, high)
+			}
+		}
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"GoTalk/nc"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// A subcommand, run instead of the tray for headless administration.
+type command struct {
+	name    string
+	usage   string
+	run     func(ctx context.Context, args []string) error
+	forward bool // Handed to the running GoTalk when there is one
+}
+
+var commands = []command{
+	{"open", "open <instance|url>       Opens an instance, or a URL belonging to one, in the browser", runOpen, true},
+	{"login", "login <instance>          Prints the login URL, then waits for the login", runLogin, true},
+	{"logout", "logout <instance>         Revokes the app password and forgets the credentials", runLogout, true},
+	{"status", "status                    Checks every account: login state and unread conversations", runStatus, true},
+	{"rooms", "rooms <instance>          Lists the conversations of an account", runRooms, true},
+	{"check-config", "check-config              Looks for mistakes in the configuration files", runCheckConfig, false},
+	{"config", "config show [--effective] Prints the configuration, or the settings in use once defaults apply", runConfig, false},
+	{"daemon", "daemon [--unit]           Runs the monitors without the tray, or prints a systemd unit for it", runDaemon, false},
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: GoTalk [command]")
+	fmt.Fprintln(os.Stderr, "Without a command, GoTalk runs in the system tray.")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintln(os.Stderr, "  "+c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Accounts are named like in the tray menu, e.g. "My Nextcloud Instance (helpdesk)".`)
+	fmt.Fprintln(os.Stderr, "While GoTalk runs, open, login, logout, status and rooms are handed to it. A URL alone stands for open <url>.")
+}
+
+// Runs a subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	attachConsole()
+
+	if isActivationURL(args[0]) {
+		args = slices.Insert(args, 0, "open")
+	}
+
+	idx := slices.IndexFunc(commands, func(c command) bool { return c.name == args[0] })
+	if idx < 0 {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			printUsage()
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, "Unknown command:", args[0])
+		printUsage()
+		return 2
+	}
+
+	if err := loadSettings(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if commands[idx].forward {
+		output, err := forwardCommand(args)
+		if !errors.Is(err, errNotRunning) {
+			if output != "" {
+				fmt.Println(output)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, commands[idx].name+":", err)
+				return 1
+			}
+			return 0
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := commands[idx].run(ctx, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, commands[idx].name+":", err)
+		return 1
+	}
+	return 0
+}
+
+// Parses the flags of a subcommand, which takes exactly nargs arguments.
+func parseArgs(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != nargs {
+		return fmt.Errorf("expected %d argument(s), got %d", nargs, fs.NArg())
+	}
+	return nil
+}
+
+// Finds an account by its name in the tray menu, ignoring case.
+func findAccount(key string) (accountRef, error) {
+	accounts := configuredAccounts()
+	idx := slices.IndexFunc(accounts, func(a accountRef) bool { return strings.EqualFold(a.key(), key) })
+	if idx < 0 {
+		names := make([]string, 0, len(accounts))
+		for _, a := range accounts {
+			names = append(names, `"`+a.key()+`"`)
+		}
+		return accountRef{}, fmt.Errorf("unknown instance %q, expected one of %s", key, strings.Join(names, ", "))
+	}
+	return accounts[idx], nil
+}
+
+// Prepares the monitor of an account, without a tray menu and without notifications.
+func commandMonitor(key string) (*monitorProcData, error) {
+	ref, err := findAccount(key)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newMonitorProc(ref, nil)
+	if err := p.setup(); err != nil {
+		return nil, err
+	}
+	p.ncMonitor.SetNotificationSender(nil)
+	p.ncMonitor.SetNotificationWithdrawer(nil)
+	return p, nil
+}
+
+// Prepares the monitor of an account for a command that only reads from the server.
+// Without a running GoTalk to hand the command to, the credentials stay as they are on disk:
+// refreshing an OAuth2 token would spend the refresh token that the next GoTalk reads.
+func readOnlyMonitor(key string) (*monitorProcData, error) {
+	p, err := commandMonitor(key)
+	if err != nil {
+		return nil, err
+	}
+	p.ncInstance.OnCredentialsUpdated(nil)
+	p.ncInstance.DisableTokenRefresh()
+	return p, nil
+}
+
+func runOpen(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("open", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+
+	output, err := openTarget(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(output)
+	return nil
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+
+	p, err := commandMonitor(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	flow := p.newLoginFlow()
+	loginURL, err := flow.Start(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Open this URL in a browser to log in to " + p.accountKey + ":")
+	fmt.Println(loginURL)
+	fmt.Printf("Waiting for the login, for up to %d minutes...\n", int(p.org.loginFlowTimeout().Minutes()))
+
+	go func() {
+		<-ctx.Done()
+		flow.Cancel()
+	}()
+
+	state, credentials, err := flow.Wait()
+	if err != nil {
+		return err
+	}
+	if state != nc.LoginFlowSucceeded || credentials == nil {
+		return errors.New("login " + state.String())
+	}
+
+	if other, ok := duplicateLogin(p.account, credentials.LoginName); ok {
+		p.revokeCredentials(ctx, *credentials)
+		return errors.New(duplicateLoginMessage(credentials.LoginName, other))
+	}
+
+	p.ncInstance.SetCredentials(*credentials)
+	fmt.Println("Logged in as " + credentials.LoginName + ".")
+	if server := flow.ServerURL(); server != "" && !strings.EqualFold(server, p.ncInstance.GetBaseURL()) {
+		fmt.Println("The server now answers at " + server + ": use the tray menu to switch to it.")
+	}
+	return nil
+}
+
+func runLogout(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("logout", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+
+	p, err := commandMonitor(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if p.ncInstance.GetCredentials().LoginName == "" {
+		fmt.Println(p.accountKey + " isn't logged in.")
+		return nil
+	}
+
+	p.logout(ctx)
+	fmt.Println("Logged out of " + p.accountKey + ".")
+	return nil
+}
+
+const statusHeader = "ACCOUNT\tLOGIN\tUSER\tLAST POLL\tUNREAD\tNOTIFYING\tLAST ACTIVITY"
+
+// Checks the login of every account, then polls the logged in ones right away.
+func runStatus(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, statusHeader)
+
+	for _, ref := range configuredAccounts() {
+		p, err := readOnlyMonitor(ref.key())
+		if err != nil {
+			fmt.Fprintf(w, "%s\tnot monitored\t-\tfailed: %s\t-\t-\t-\n", ref.key(), err)
+			continue
+		}
+
+		login, poll, unread, notifying, activity := "logged out", "-", "-", "-", "-"
+		credentials := p.ncInstance.GetCredentials()
+		if credentials.LoginName != "" {
+			result, err := p.handleFirstLoginCheck(ctx)
+			switch {
+			case err != nil:
+				login = "unknown"
+				poll = "failed: " + err.Error()
+			case result == nc.CredentialsExpired:
+				login = "expired"
+			case result == nc.CredentialsInvalid:
+				login = "invalid"
+			default:
+				login = "logged in"
+
+				var unfiltered, filtered uint
+				p.ncMonitor.SetNotificationCountSetter(func(instance string, unfilteredCount uint, filteredCount uint) error {
+					unfiltered, filtered = unfilteredCount, filteredCount
+					return nil
+				})
+
+				started := time.Now()
+				if err := p.ncMonitor.ProcessMessages(ctx); err != nil {
+					poll = "failed: " + err.Error()
+				} else {
+					poll = "ok in " + time.Since(started).Round(time.Millisecond).String()
+					unread = fmt.Sprint(unfiltered)
+					notifying = fmt.Sprint(filtered)
+					if last := p.ncMonitor.Activity().LastActivity; !last.IsZero() {
+						activity = last.Format(time.DateTime)
+					}
+				}
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ref.key(), login, cmp.Or(credentials.LoginName, "-"), poll, unread, notifying, activity)
+	}
+
+	return w.Flush()
+}
+
+// Answers "GoTalk status" in the running GoTalk, from what its monitors saw last.
+// Nothing is sent to the servers.
+func runningStatus(args []string) (string, error) {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, statusHeader)
+
+	for _, ref := range configuredAccounts() {
+		monitorsMutex.Lock()
+		p, ok := monitors[ref.key()]
+		monitorsMutex.Unlock()
+		if !ok {
+			fmt.Fprintf(w, "%s\tnot monitored\t-\t-\t-\t-\t-\n", ref.key())
+			continue
+		}
+
+		d := p.diagnostics()
+		poll, unread, notifying, activity := "-", "-", "-", "-"
+		switch {
+		case d.LastError != "":
+			poll = "failed: " + d.LastError
+		case !d.LastCheck.IsZero():
+			poll = "ok at " + d.LastCheck.Format(time.TimeOnly)
+		}
+		if d.Counted {
+			unread = fmt.Sprint(d.Unread)
+			notifying = fmt.Sprint(d.Notifying)
+		}
+		if !d.LastActivity.IsZero() {
+			activity = d.LastActivity.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ref.key(), cmp.Or(d.Login, "checking"), cmp.Or(d.User, "-"), poll, unread, notifying, activity)
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+func parseRoomsArgs(args []string) (key string, unreadOnly bool, err error) {
+	fs := flag.NewFlagSet("rooms", flag.ContinueOnError)
+	unread := fs.Bool("unread", false, "Only list conversations with unread messages")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return "", false, err
+	}
+	return fs.Arg(0), *unread, nil
+}
+
+func runRooms(ctx context.Context, args []string) error {
+	key, unreadOnly, err := parseRoomsArgs(args)
+	if err != nil {
+		return err
+	}
+
+	p, err := readOnlyMonitor(key)
+	if err != nil {
+		return err
+	}
+
+	conversations, err := p.ncInstance.GetUserConversations(ctx)
+	if err != nil {
+		return err
+	}
+	return printRooms(os.Stdout, *conversations, unreadOnly)
+}
+
+// Answers "GoTalk rooms" in the running GoTalk, with the instance of the monitor:
+// a second instance could refresh the OAuth2 token behind its back.
+func runningRooms(args []string) (string, error) {
+	key, unreadOnly, err := parseRoomsArgs(args)
+	if err != nil {
+		return "", err
+	}
+	ref, err := findAccount(key)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	done := make(chan error, 1)
+	err = queueMonitorQuery(ref.key(), func(ctx context.Context, p *monitorProcData) {
+		conversations, err := p.ncInstance.GetUserConversations(ctx)
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- printRooms(&sb, *conversations, unreadOnly)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(sb.String(), "\n"), nil
+	case <-time.After(forwardQueryTimeout):
+		return "", errors.New(ref.key() + " didn't answer, see the log of the running GoTalk")
+	}
+}
+
+func printRooms(out io.Writer, conversations []nc.NextcloudSpreedConversationData, unreadOnly bool) error {
+	slices.SortFunc(conversations, func(a, b nc.NextcloudSpreedConversationData) int {
+		return cmp.Compare(b.LastActivity, a.LastActivity)
+	})
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN\tNAME\tKIND\tUNREAD\tMENTION\tMUTED\tLAST ACTIVITY")
+	for _, conv := range conversations {
+		if unreadOnly && conv.UnreadMessages == 0 {
+			continue
+		}
+
+		mention := ""
+		if conv.UnreadMention {
+			mention = "yes"
+		}
+		muted := ""
+		if conv.NotificationLevel == 3 {
+			// The conversation never notifies
+			muted = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			conv.Token,
+			conv.DisplayName,
+			nc.ClassifyConversation(&conv),
+			conv.UnreadMessages,
+			mention,
+			muted,
+			time.Unix(conv.LastActivity, 0).Format(time.DateTime),
+		)
+	}
+	return w.Flush()
+}
+
+// Lists the mistakes found in the configuration. Nothing is sent to the servers.
+func configProblems() []string {
+	var problems []string
+	report := func(instance string, format string, args ...any) {
+		problems = append(problems, instance+": "+fmt.Sprintf(format, args...))
+	}
+
+	if org.UserInstances < UserInstancesForbidden || org.UserInstances > UserInstancesAllowlist {
+		report("UserInstances", "unknown policy %d", org.UserInstances)
+	}
+	if org.UserInstances == UserInstancesAllowlist && len(org.UserInstanceDomains) == 0 {
+		report("UserInstances", "the allowlist is empty, no instance can be added")
+	}
+	if len(org.InstanceData) == 0 && org.UserInstances == UserInstancesForbidden {
+		report("InstanceData", "no instance is configured")
+	}
+	if _, err := newNotificationBackend(user.Daemon); err != nil {
+		report("Daemon", "%s", err)
+	}
+
+	for name, o := range org.InstanceData {
+		u, err := url.Parse(o.InstanceURL)
+		switch {
+		case o.InstanceURL == "":
+			report(name, "InstanceURL is empty")
+		case err != nil || u.Host == "":
+			report(name, "InstanceURL %q isn't an absolute URL", o.InstanceURL)
+		case u.Scheme != "https":
+			report(name, "InstanceURL %q doesn't use HTTPS", o.InstanceURL)
+		}
+
+		if o.Login < LoginWithNotification || o.Login > LoginWithOAuth2 {
+			report(name, "unknown Login mode %d", o.Login)
+		}
+		if o.Login == LoginWithOAuth2 && o.OAuth2ClientID == "" {
+			report(name, "Login = %d needs an OAuth2ClientID", LoginWithOAuth2)
+		}
+		if o.BackoffJitter >= 1 {
+			report(name, "BackoffJitter must be below 1, or negative for no jitter")
+		}
+		if o.MinCheckInterval > 0 && o.MaxCheckInterval > 0 && o.MinCheckInterval > o.MaxCheckInterval {
+			report(name, "MinCheckInterval is above MaxCheckInterval")
+		}
+
+		if o.ProxyPAC != "" && o.ProxyURL == "" && !nc.PACSupported {
+			report(name, "ProxyPAC is only supported on Windows, the proxy environment variables are used instead")
+		}
+
+		// Builds the HTTP client, which reads the certificates and the proxy settings.
+		if err := nc.NewInstance(name, o.InstanceURL).SetHTTPSettings(o.httpSettings()); err != nil {
+			report(name, "invalid connection settings, the instance isn't monitored: %v", err)
+		}
+	}
+
+	for name, u := range user.UserInstances {
+		if _, ok := org.InstanceData[name]; ok {
+			report(name, "added by the user, but also configured by the organization: the user entry is ignored")
+		} else if err := org.checkUserInstance(u.InstanceURL); err != nil {
+			report(name, "added by the user, ignored: %v", err)
+		}
+	}
+
+	for name, data := range user.InstanceData {
+		if len(data.Accounts) > 0 {
+			if _, ok := instanceSettings(name); !ok {
+				report(name, "has additional accounts, but the instance isn't configured")
+			}
+		}
+	}
+
+	if _, err := nc.CompileWatchlist(user.Watchlist); err != nil {
+		report("Watchlist", "%v", err)
+	}
+
+	slices.Sort(problems)
+	return problems
+}
+
+func runCheckConfig(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	problems := configProblems()
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	}
+
+	fmt.Println("No problem found.")
+	return nil
+}
+
+// Settings of one account once every default applies, as printed by "config show --effective".
+// Durations are written out with their unit.
+type effectiveAccountSettings struct {
+	Instance    string
+	Account     string
+	AddedByUser bool
+	InstanceURL string
+	LoggedInAs  string
+
+	Login              LoginType
+	LoginTimeout       string
+	LoginPollInterval  string
+	LoginReminders     int
+	LoginReminderDelay string
+
+	MinCheckInterval  string
+	MaxCheckInterval  string
+	BackoffInitial    string
+	BackoffMax        string
+	BackoffMultiplier float64
+	BackoffJitter     float64
+
+	ConnectTimeout string
+	RequestTimeout string
+	RetryCount     int
+	RetryDelay     string
+	ProxyURL       string
+	ProxyPAC       string
+
+	NotificationSettings nc.NotificationSettings
+}
+
+type effectiveSettings struct {
+	ShowNotifications      bool
+	PlayNotificationSounds bool
+	UserInstances          UserInstancePolicy
+	Accounts               map[string]effectiveAccountSettings
+}
+
+func effectiveConfig() effectiveSettings {
+	settings := effectiveSettings{
+		ShowNotifications:      user.ShowNotifications,
+		PlayNotificationSounds: user.PlayNotificationSounds,
+		UserInstances:          org.UserInstances,
+		Accounts:               make(map[string]effectiveAccountSettings),
+	}
+
+	for _, ref := range configuredAccounts() {
+		o, _ := instanceSettings(ref.instance)
+		_, orgInstance := org.InstanceData[ref.instance]
+		reminders, reminderDelay := o.loginReminderPolicy()
+		poll := o.pollScheduler(org.MessageCheckTime)
+		backoff := o.backoffPolicy()
+		httpSettings := o.httpSettings().WithDefaults()
+
+		settings.Accounts[ref.key()] = effectiveAccountSettings{
+			Instance:    ref.instance,
+			Account:     ref.account,
+			AddedByUser: !orgInstance,
+			InstanceURL: instanceURL(ref.instance),
+			LoggedInAs:  cache.InstanceData[ref.key()].Username,
+
+			Login:              o.Login,
+			LoginTimeout:       o.loginFlowTimeout().String(),
+			LoginPollInterval:  o.loginFlowPollInterval().String(),
+			LoginReminders:     reminders,
+			LoginReminderDelay: reminderDelay.String(),
+
+			MinCheckInterval:  poll.fast.String(),
+			MaxCheckInterval:  poll.idle.String(),
+			BackoffInitial:    backoff.initial.String(),
+			BackoffMax:        backoff.max.String(),
+			BackoffMultiplier: backoff.multiplier,
+			BackoffJitter:     backoff.jitter,
+
+			ConnectTimeout: httpSettings.DialTimeout.String(),
+			RequestTimeout: httpSettings.RequestTimeout.String(),
+			RetryCount:     httpSettings.MaxRetries,
+			RetryDelay:     httpSettings.RetryDelay.String(),
+			ProxyURL:       o.ProxyURL,
+			ProxyPAC:       o.ProxyPAC,
+
+			NotificationSettings: user.InstanceData[ref.key()].NotificationSettings,
+		}
+	}
+	return settings
+}
+
+func runConfig(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return errors.New(`expected "config show"`)
+	}
+
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	effective := fs.Bool("effective", false, "Print the settings of every account once defaults apply")
+	if err := parseArgs(fs, args[1:], 0); err != nil {
+		return err
+	}
+
+	if *effective {
+		return toml.NewEncoder(os.Stdout).Encode(effectiveConfig())
+	}
+
+	// The OAuth2 client secret is the only secret of the organization file.
+	orgCopy := *org
+	orgCopy.InstanceData = make(map[string]OrgInstanceSettings, len(org.InstanceData))
+	for name, o := range org.InstanceData {
+		if o.OAuth2ClientSecret != "" {
+			o.OAuth2ClientSecret = "********"
+		}
+		orgCopy.InstanceData[name] = o
+	}
+
+	fmt.Println("# Organization configuration")
+	if err := toml.NewEncoder(os.Stdout).Encode(orgCopy); err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("# User configuration")
+	return toml.NewEncoder(os.Stdout).Encode(user)
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package main
+
+// Outside of Windows, the console is always there.
+func attachConsole() {}
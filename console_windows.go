@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ATTACH_PARENT_PROCESS, as a DWORD
+const attachParentProcess = ^uint32(0)
+
+// GUI builds start without a console.
+// Subcommands borrow the console of the shell that started them, so that they can print.
+func attachConsole() {
+	if handle, err := syscall.GetStdHandle(syscall.STD_OUTPUT_HANDLE); err == nil && handle != 0 && handle != syscall.InvalidHandle {
+		// The output is already redirected, e.g. to a file or an SSH session.
+		return
+	}
+
+	attach := syscall.NewLazyDLL("kernel32.dll").NewProc("AttachConsole")
+	if r, _, _ := attach.Call(uintptr(attachParentProcess)); r == 0 {
+		return
+	}
+
+	if out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout = out
+		os.Stderr = out
+	}
+}
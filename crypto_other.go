@@ -0,0 +1,102 @@
+//go:build !windows
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Without DPAPI, secrets are sealed with AES-GCM, using a random key that only the user can read.
+// Like DPAPI, a copy of the cache alone doesn't leak the app passwords.
+var (
+	cryptoKeyOnce sync.Once
+	cryptoKey     []byte
+	cryptoKeyErr  error
+)
+
+func loadCryptoKey() ([]byte, error) {
+	cryptoKeyOnce.Do(func() {
+		// Kept away from the cache, which holds the sealed secrets.
+		dir, err := settingsManager.UserDir()
+		if err != nil {
+			cryptoKeyErr = err
+			return
+		}
+		path := dir + string(os.PathSeparator) + "GoTalk.key"
+
+		key, err := os.ReadFile(path)
+		if err == nil && len(key) == 32 {
+			cryptoKey = key
+			return
+		}
+		if err != nil && !os.IsNotExist(err) {
+			cryptoKeyErr = err
+			return
+		}
+
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			cryptoKeyErr = err
+			return
+		}
+		// A new key makes the secrets sealed with the old one unreadable: they read as logged out.
+		if err := os.WriteFile(path, key, os.FileMode(0600)); err != nil {
+			cryptoKeyErr = err
+			return
+		}
+		cryptoKey = key
+	})
+	return cryptoKey, cryptoKeyErr
+}
+
+func newCryptoAEAD() (cipher.AEAD, error) {
+	key, err := loadCryptoKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func crypto_decrypt(encryptedInput string) (string, error) {
+	aead, err := newCryptoAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encryptedInput)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted secret too short")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func crypto_encrypt(rawInput string) (string, error) {
+	aead, err := newCryptoAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(rawInput), nil)), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Set by the daemon: there is no tray to show windows or menus.
+var headless bool
+
+// Watchdog interval written in the generated unit
+const daemonWatchdogSec = 120
+
+// Prints a systemd user unit running the daemon.
+func printDaemonUnit() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(`[Unit]
+Description=GoTalk Nextcloud Talk notifications
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=%s daemon
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=30
+WatchdogSec=%d
+
+[Install]
+WantedBy=default.target
+`, strconv.Quote(executable), daemonWatchdogSec)
+	return nil
+}
+
+// Sends a state change to the service manager, if there is one.
+// See sd_notify(3): a datagram to the socket in $NOTIFY_SOCKET, a leading "@" meaning an abstract socket.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// How often the service manager expects a watchdog ping, or zero without a watchdog.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pets the watchdog as long as every monitor loop makes progress.
+// A stalled loop stops the pings: the service manager then restarts the daemon.
+func runWatchdog(interval time.Duration, done chan interface{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if stalled := stalledMonitors(); len(stalled) > 0 {
+				log.Print("watchdog: no progress from " + strings.Join(stalled, ", "))
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Print(err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Runs the monitors without the tray until SIGTERM, reloading the configuration on SIGHUP.
+func runDaemon(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	unit := fs.Bool("unit", false, "print a systemd user unit instead of running")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *unit {
+		return printDaemonUnit()
+	}
+
+	lock, err := acquireInstanceLock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if err := registerURIScheme(); err != nil {
+		log.Print(err)
+	}
+	headless = true
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if interval := sdWatchdogInterval(); interval > 0 {
+		done := make(chan interface{})
+		defer close(done)
+		go runWatchdog(interval, done)
+	}
+
+	for {
+		backend, err := newNotificationBackend(user.Daemon)
+		if err != nil {
+			return err
+		}
+		notifications = backend
+
+		var wg sync.WaitGroup
+		closeChan := make(chan interface{})
+		if err := startNextcloudMonitor(&wg, closeChan, nil); err != nil {
+			close(closeChan)
+			return err
+		}
+		startWakeDetection(closeChan)
+
+		sdNotify(fmt.Sprintf("READY=1\nSTATUS=Monitoring %d account(s)", len(configuredAccounts())))
+
+		reload := false
+		select {
+		case sig := <-signals:
+			reload = sig == syscall.SIGHUP
+		case <-ctx.Done():
+		}
+
+		if reload {
+			sdNotify("RELOADING=1")
+		} else {
+			sdNotify("STOPPING=1")
+		}
+		close(closeChan)
+		stopped := waitForMonitors(&wg, shutdownTimeout)
+
+		if !reload {
+			return nil
+		}
+		if !stopped {
+			// Two monitors of the same account must not run side by side:
+			// if one is stuck for good, the watchdog gets the daemon restarted.
+			wg.Wait()
+		}
+
+		// The monitors saved their state as they went: read back what changed on disk,
+		// e.g. credentials from "GoTalk login".
+		if err := loadSettings(); err != nil {
+			return errors.New("reloading the configuration: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type monitorDiagnostics struct {
+	LastCheck         time.Time     // When the last check ended
+	LastError         string        // Error of the last check, empty if it succeeded
+	Failures          int           // Consecutive failed checks
+	EffectiveInterval time.Duration // Wait before the next check
+
+	Login        string    // Login state, as shown by "GoTalk status"
+	User         string    // Login name of the account
+	Unread       uint      // Conversations with unread messages, at the last poll
+	Notifying    uint      // Those of them that the notification settings let through
+	Counted      bool      // Whether Unread and Notifying come from a poll
+	LastActivity time.Time // Most recent activity in the conversations of the account
+}
+
+const (
+	loginStateLoggedIn     = "logged in"
+	loginStateLoggedOut    = "logged out"
+	loginStateNotMonitored = "not monitored"
+)
+
+func (d monitorDiagnostics) String() string {
+	if d.LastCheck.IsZero() {
+		return "No check yet"
+	}
+
+	lines := []string{
+		"Last check: " + d.LastCheck.Format(time.TimeOnly),
+		"Next check in: " + d.EffectiveInterval.Round(time.Second).String(),
+	}
+	if d.LastError != "" {
+		lines = append(lines, fmt.Sprintf("Last error: %s (%d in a row)", d.LastError, d.Failures))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *monitorProcData) updateDiagnostics(err error, delay time.Duration) {
+	activity := p.ncMonitor.Activity().LastActivity
+
+	p.diagMutex.Lock()
+	defer p.diagMutex.Unlock()
+
+	p.diag.LastCheck = time.Now()
+	p.diag.LastError = ""
+	if err != nil {
+		p.diag.LastError = err.Error()
+	}
+	p.diag.Failures = p.failures
+	p.diag.EffectiveInterval = delay
+	p.diag.LastActivity = activity
+}
+
+func (p *monitorProcData) updateLoginState(state string) {
+	loginName := p.ncInstance.GetCredentials().LoginName
+
+	p.diagMutex.Lock()
+	defer p.diagMutex.Unlock()
+
+	p.diag.Login = state
+	p.diag.User = loginName
+	if state != loginStateLoggedIn {
+		p.diag.Counted = false
+	}
+}
+
+func (p *monitorProcData) updateSetupError(err error) {
+	p.diagMutex.Lock()
+	defer p.diagMutex.Unlock()
+
+	p.diag.Login = loginStateNotMonitored
+	p.diag.LastError = err.Error()
+}
+
+func (p *monitorProcData) updateCounts(instance string, unread uint, notifying uint) error {
+	p.diagMutex.Lock()
+	defer p.diagMutex.Unlock()
+
+	p.diag.Unread = unread
+	p.diag.Notifying = notifying
+	p.diag.Counted = true
+	return nil
+}
+
+func (p *monitorProcData) diagnostics() monitorDiagnostics {
+	p.diagMutex.Lock()
+	defer p.diagMutex.Unlock()
+
+	return p.diag
+}
+
+// Shows the diagnostics of an account in a notification.
+func showMonitorDiagnostics(accountKey string) {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	p.sendNotification(nc.Notification{
+		Instance: accountKey,
+		Title:    accountKey + " diagnostics",
+		Message:  p.diagnostics().String(),
+		Urgency:  nc.UrgencyLow,
+	})
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Takes an exclusive lock on the file, failing right away if another process holds it.
+// The lock goes away with the process.
+func lockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
+
+// Whether lockFile failed because another process holds the lock, rather than because locking isn't possible.
+func isLockHeld(err error) bool {
+	return errors.Is(err, unix.EWOULDBLOCK)
+}
+
+// Lets only the user connect to the socket of the running process.
+func restrictSocket(path string) error {
+	return os.Chmod(path, 0600)
+}
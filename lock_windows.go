@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Takes an exclusive lock on the file, failing right away if another process holds it.
+// The lock goes away with the process.
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &windows.Overlapped{})
+}
+
+// Whether lockFile failed because another process holds the lock, rather than because locking isn't possible.
+func isLockHeld(err error) bool {
+	return errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
+
+// The socket lives in the profile of the user, which other users can't access.
+func restrictSocket(path string) error {
+	return nil
+}
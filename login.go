@@ -0,0 +1,371 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/pkg/browser"
+)
+
+// What a login strategy shows while the login flow is pending.
+type loginPrompt struct {
+	update   func(progress nc.LoginFlowProgress) // Optional: shows the progress of the flow
+	dismiss  func()                              // Optional: hides the prompt once the flow ended
+	loginURL string                              // The login page, handed to forwarded login commands while the flow is pending
+}
+
+// Chooses how the user is asked to log in.
+// A strategy either presents the login page of a login flow (flowLogin), or logs in on its own (credentialsLogin).
+type LoginStrategy interface {
+	// Whether the login only starts once the user clicks "Log In" in the tray.
+	WaitsForUser() bool
+}
+
+// Strategies sharing the login flow: they only differ in how the login page is presented.
+type flowLogin interface {
+	LoginStrategy
+
+	// Presents the login page. cancel aborts the login flow, for prompts the user can close.
+	Present(p *monitorProcData, loginURL string, cancel func()) (loginPrompt, error)
+}
+
+// A login in progress: a Login Flow v2, or an OAuth2 authorization.
+type pendingLogin interface {
+	Start(ctx context.Context) (string, error)
+	Wait() (nc.LoginFlowState, *nc.AuthCredentials, error)
+	Cancel()
+	ServerURL() string
+}
+
+// Strategies logging in without a login flow.
+type credentialsLogin interface {
+	LoginStrategy
+
+	login(ctx context.Context, p *monitorProcData) (chan loginFlowOutcome, error)
+}
+
+// Opens the login page in the browser, or sends a notification if the browser can't be opened.
+type browserLogin struct{}
+
+func (browserLogin) WaitsForUser() bool { return false }
+
+func (browserLogin) Present(p *monitorProcData, loginURL string, cancel func()) (loginPrompt, error) {
+	if err := browser.OpenURL(loginURL); err != nil {
+		// Could not open the browser: Send a notification.
+		return loginPrompt{}, p.sendLoginNotification(loginURL)
+	}
+	return loginPrompt{}, nil
+}
+
+// Sends a notification opening the login page when clicked.
+type notificationLogin struct{}
+
+func (notificationLogin) WaitsForUser() bool { return false }
+
+func (notificationLogin) Present(p *monitorProcData, loginURL string, cancel func()) (loginPrompt, error) {
+	return loginPrompt{}, p.sendLoginNotification(loginURL)
+}
+
+// Waits for "Log In" in the tray, then logs in like the wrapped strategy.
+type contextMenuLogin struct {
+	then LoginStrategy
+}
+
+func (contextMenuLogin) WaitsForUser() bool { return true }
+
+// Shows the login page as a QR code.
+type qrCodeLogin struct{}
+
+func (qrCodeLogin) WaitsForUser() bool { return false }
+
+func (qrCodeLogin) Present(p *monitorProcData, loginURL string, cancel func()) (loginPrompt, error) {
+	return showQRLoginWindow(p.accountKey, loginURL, p.org.loginFlowTimeout(), cancel)
+}
+
+// Shows a window explaining which instance wants a login, with the live flow status.
+type dialogLogin struct{}
+
+func (dialogLogin) WaitsForUser() bool { return false }
+
+func (dialogLogin) Present(p *monitorProcData, loginURL string, cancel func()) (loginPrompt, error) {
+	return showLoginDialog(p.accountKey, loginURL, cancel), nil
+}
+
+// Hands the login page to another GoTalk process, which forwarded a login command.
+type forwardedLogin struct {
+	urls chan<- string // Buffered: receives the login page once
+}
+
+func (forwardedLogin) WaitsForUser() bool { return false }
+
+func (f forwardedLogin) Present(p *monitorProcData, loginURL string, cancel func()) (loginPrompt, error) {
+	f.urls <- loginURL
+	return loginPrompt{}, nil
+}
+
+func (p *monitorProcData) loginStrategy() (LoginStrategy, error) {
+	var strategy LoginStrategy
+	switch p.org.Login {
+	case LoginWithNotification:
+		strategy = notificationLogin{}
+	case LoginImmediately, LoginWithOAuth2:
+		strategy = browserLogin{}
+	case LoginWithContextMenu:
+		strategy = contextMenuLogin{browserLogin{}}
+	case LoginWithQRCode:
+		strategy = qrCodeLogin{}
+	case LoginWithDialog:
+		strategy = dialogLogin{}
+	case LoginWithAppPassword:
+		strategy = appPasswordLogin{}
+	default:
+		return nil, errors.New("invalid login mode")
+	}
+
+	if headless {
+		// Without the tray, the login page can only go through the notifications.
+		switch strategy.(type) {
+		case browserLogin, notificationLogin:
+		default:
+			strategy = notificationLogin{}
+		}
+	}
+
+	if p.loggedOut {
+		// Don't prompt again right after the user logged out or dismissed a prompt:
+		// wait for "Log In" in the tray instead.
+		switch strategy.(type) {
+		case contextMenuLogin:
+			return strategy, nil
+		case notificationLogin:
+			strategy = browserLogin{}
+		}
+		return contextMenuLogin{strategy}, nil
+	}
+	return strategy, nil
+}
+
+// Starts logging in following the login strategy of the instance.
+// The returned channel receives the outcome of the login, then gets closed.
+func (p *monitorProcData) handleLoginRequired(ctx context.Context) (chan loginFlowOutcome, error) {
+	strategy, err := p.loginStrategy()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strategy.WaitsForUser() {
+		return p.startLoginFlow(ctx, strategy)
+	}
+	p.waitForUser()
+	if headless {
+		// Without the tray, the notification stands in for its "Log In" option.
+		log.Printf("%s: login required, run GoTalk login %q", p.accountKey, p.accountKey)
+		if err := p.sendLoginRequiredNotification(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if menu, ok := strategy.(contextMenuLogin); ok {
+		strategy = menu.then
+	}
+
+	chanLoginFlow := make(chan loginFlowOutcome, 1)
+	p.setLoginOption(func(override LoginStrategy) {
+		if override != nil {
+			strategy = override
+		}
+		p.tasks.Add(1)
+		go func() {
+			defer p.tasks.Done()
+			defer close(chanLoginFlow)
+
+			chanFlow, err := p.startLoginFlow(ctx, strategy)
+			if err != nil {
+				log.Print(err)
+				chanLoginFlow <- loginFlowOutcome{LoginFlowError, nc.AuthCredentials{}}
+				return
+			}
+
+			var outcome loginFlowOutcome
+			select {
+			case outcome = <-chanFlow:
+			case <-ctx.Done():
+				// Don't hang on to a prompt when the monitor is stopping.
+				chanLoginFlow <- loginFlowOutcome{LoginFlowCanceled, nc.AuthCredentials{}}
+				return
+			}
+			if outcome.LoginFlowResult == LoginFlowExpired {
+				// The user asked for this login: the tray option is reminder enough.
+				outcome.LoginFlowResult = LoginFlowCanceled
+			}
+			chanLoginFlow <- outcome
+		}()
+	})
+	return chanLoginFlow, nil
+}
+
+// Logs in with the given strategy, which can't wait for the user anymore.
+func (p *monitorProcData) startLoginFlow(ctx context.Context, strategy LoginStrategy) (chan loginFlowOutcome, error) {
+	switch s := strategy.(type) {
+	case credentialsLogin:
+		p.waitForUser()
+		return s.login(ctx, p)
+	case flowLogin:
+		return p.presentLoginFlow(ctx, s)
+	}
+	return nil, fmt.Errorf("%s: %T can't start a login", p.accountKey, strategy)
+}
+
+// Starts a login flow and presents it with the given strategy.
+func (p *monitorProcData) presentLoginFlow(ctx context.Context, strategy flowLogin) (chan loginFlowOutcome, error) {
+	// The login flow gives up on its own once it times out.
+	p.expectProgress(p.org.loginFlowTimeout() + p.checkBudget())
+	loginFlow := p.newLoginFlow()
+
+	url, err := loginFlow.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt, err := strategy.Present(p, url, loginFlow.Cancel)
+	if err != nil {
+		loginFlow.Cancel()
+		return nil, err
+	}
+	prompt.loginURL = url
+	p.setLoginPrompt(prompt)
+
+	chanLoginFlow := make(chan loginFlowOutcome, 1)
+	p.tasks.Add(1)
+	go func() {
+		defer p.tasks.Done()
+		defer close(chanLoginFlow)
+
+		state, cred, err := loginFlow.Wait()
+		p.setLoginPrompt(loginPrompt{})
+		if prompt.dismiss != nil {
+			prompt.dismiss()
+		}
+
+		switch {
+		case state == nc.LoginFlowSucceeded && cred != nil:
+			chanLoginFlow <- loginFlowOutcome{LoginFlowSuccessful, *cred}
+		case state == nc.LoginFlowExpired:
+			chanLoginFlow <- loginFlowOutcome{LoginFlowExpired, nc.AuthCredentials{}}
+		case state == nc.LoginFlowCancelled && errors.Is(err, nc.ErrLoginFlowCancelled):
+			// The user dismissed the prompt: don't show it again right away.
+			p.loggedOut = true
+			chanLoginFlow <- loginFlowOutcome{LoginFlowCanceled, nc.AuthCredentials{}}
+		case state == nc.LoginFlowCancelled:
+			chanLoginFlow <- loginFlowOutcome{LoginFlowCanceled, nc.AuthCredentials{}}
+		default:
+			log.Print(err)
+			chanLoginFlow <- loginFlowOutcome{LoginFlowError, nc.AuthCredentials{}}
+		}
+	}()
+
+	return chanLoginFlow, nil
+}
+
+func (p *monitorProcData) newLoginFlow() pendingLogin {
+	if p.org.Login == LoginWithOAuth2 {
+		oauth2Flow := p.ncInstance.NewOAuth2Flow(p.org.oauth2Config())
+		oauth2Flow.SetTimeout(p.org.loginFlowTimeout())
+		oauth2Flow.OnProgress(p.showLoginProgress)
+		return oauth2Flow
+	}
+
+	loginFlow := p.ncInstance.NewLoginFlow()
+	loginFlow.SetTimeout(p.org.loginFlowTimeout())
+	loginFlow.SetPollInterval(p.org.loginFlowPollInterval())
+	loginFlow.OnProgress(func(progress nc.LoginFlowProgress) {
+		p.showLoginProgress(progress)
+		if progress.State == nc.LoginFlowSucceeded {
+			p.offerServerURL(loginFlow.ServerURL())
+		}
+	})
+	return loginFlow
+}
+
+// Offers to log in, from the tray and to forwarded commands, or withdraws the offer with a nil callback.
+func (p *monitorProcData) setLoginOption(login func(LoginStrategy)) {
+	p.promptMutex.Lock()
+	p.loginOption = login
+	p.promptMutex.Unlock()
+
+	if login == nil {
+		p.menu.setLoginOption(nil)
+		return
+	}
+	p.menu.setLoginOption(func() {
+		if login := p.takeLoginOption(); login != nil {
+			login(nil)
+		}
+	})
+}
+
+// Withdraws the login offer and returns it: one click is enough, the offer comes back if this login fails.
+func (p *monitorProcData) takeLoginOption() func(LoginStrategy) {
+	p.promptMutex.Lock()
+	login := p.loginOption
+	p.loginOption = nil
+	p.promptMutex.Unlock()
+
+	p.menu.setLoginOption(nil)
+	return login
+}
+
+func (p *monitorProcData) setLoginPrompt(prompt loginPrompt) {
+	p.promptMutex.Lock()
+	defer p.promptMutex.Unlock()
+	p.prompt = prompt
+}
+
+// The login page of the pending login flow, empty when none is pending.
+func (p *monitorProcData) pendingLoginURL() string {
+	p.promptMutex.Lock()
+	defer p.promptMutex.Unlock()
+	return p.prompt.loginURL
+}
+
+// Shows how long the user has left to log in, in the tray and in the login prompt.
+func (p *monitorProcData) showLoginProgress(progress nc.LoginFlowProgress) {
+	p.promptMutex.Lock()
+	update := p.prompt.update
+	p.promptMutex.Unlock()
+
+	if update != nil {
+		update(progress)
+	}
+
+	if progress.State != nc.LoginFlowPending {
+		p.setStatus("")
+		return
+	}
+	p.setStatus(fmt.Sprintf("Waiting for login (%d min left)", int(math.Ceil(progress.Remaining.Minutes()))))
+}
+
+// An expired login flow means nobody answered the prompt.
+// The prompt comes back after a growing delay, and stops after a few reminders:
+// from then on, the user logs in from the tray.
+// Returns false if the app is quitting.
+func (p *monitorProcData) remindLogin(closeChan chan interface{}) bool {
+	p.unattendedLogins++
+
+	reminders, delay := p.org.loginReminderPolicy()
+	if p.unattendedLogins > reminders {
+		p.loggedOut = true
+		p.setStickyStatus("Login required")
+		return true
+	}
+
+	for range p.unattendedLogins - 1 {
+		delay *= 2
+	}
+	return p.wait(min(delay, time.Hour*24), closeChan)
+}
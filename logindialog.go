@@ -0,0 +1,83 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"fmt"
+	"net/url"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/pkg/browser"
+)
+
+// Shows which instance wants a login, with buttons to open or copy the login page.
+// The status line follows the login flow. Closing the window calls cancel.
+func showLoginDialog(instanceName string, loginURL string, cancel func()) loginPrompt {
+	window := fyne.CurrentApp().NewWindow(instanceName + " - Log In")
+	done := make(chan struct{})
+
+	title := widget.NewLabelWithStyle(instanceName+" needs you to log in", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+
+	host := loginURL
+	if u, err := url.Parse(loginURL); err == nil {
+		host = u.Host
+	}
+	hint := widget.NewLabel("GoTalk checks " + host + " for new Talk messages. " +
+		"Log in from the browser and grant access: GoTalk receives its own app password, " +
+		"which can be revoked at any time from the Nextcloud security settings.")
+	hint.Wrapping = fyne.TextWrapWord
+
+	status := widget.NewLabel("Waiting for the login…")
+
+	openBrowser := widget.NewButton("Open browser", func() {
+		if err := browser.OpenURL(loginURL); err != nil {
+			status.SetText("Could not open the browser: copy the link instead.")
+		}
+	})
+	openBrowser.Importance = widget.HighImportance
+
+	copyLink := widget.NewButton("Copy link", func() {
+		window.Clipboard().SetContent(loginURL)
+		status.SetText("Link copied: paste it in a browser.")
+	})
+
+	window.SetContent(container.NewVBox(
+		title,
+		hint,
+		status,
+		container.NewHBox(openBrowser, copyLink, widget.NewButton("Cancel", window.Close)),
+	))
+	window.Resize(fyne.NewSize(440, 0))
+	window.CenterOnScreen()
+	window.SetOnClosed(func() {
+		close(done)
+		cancel()
+	})
+	window.Show()
+	window.RequestFocus()
+
+	return loginPrompt{
+		update: func(progress nc.LoginFlowProgress) {
+			switch progress.State {
+			case nc.LoginFlowPending:
+				remaining := progress.Remaining.Round(time.Second)
+				status.SetText(fmt.Sprintf("Waiting for the login (%d:%02d left)", int(remaining.Minutes()), int(remaining.Seconds())%60))
+			case nc.LoginFlowSucceeded:
+				status.SetText("Logged in.")
+			case nc.LoginFlowExpired:
+				status.SetText("The login expired.")
+			case nc.LoginFlowFailed:
+				status.SetText("The login failed.")
+			}
+		},
+		dismiss: func() {
+			select {
+			case <-done:
+			default:
+				window.Close()
+			}
+		},
+	}
+}
@@ -4,17 +4,17 @@ package main
 //go:generate fyne bundle -o rsrc_defaulticon_png.go DefaultIcon.png
 
 import (
+	"errors"
 	"log"
 	"os"
-	"sort"
+	"os/signal"
+	"slices"
 	"sync"
+	"syscall"
 
 	"GoTalk/nc"
 	"GoTalk/settings"
 
-	"github.com/pkg/browser"
-	"gopkg.in/toast.v1"
-
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/driver/desktop"
@@ -26,22 +26,25 @@ var (
 	user  *UserSettings
 	org   *OrgSettings
 
+	// Guards cache, user and org, shared by the tray, the monitors and forwarded commands,
+	// and keeps two saves from writing the files at the same time.
+	settingsMutex sync.Mutex
+
 	settingsManager *settings.SettingsManager[Cache, UserSettings, OrgSettings]
 )
 
-func sendMessageNotification(instance string, title string, message string, url string, playAudio bool) error {
-	if !user.ShowNotifications {
-		return nil
-	}
-
-	var err error
+func sendMessageNotification(n nc.Notification, orgInstance OrgInstanceSettings) (nc.NotificationResult, error) {
+	settingsMutex.Lock()
+	showNotifications, playSounds := user.ShowNotifications, user.PlayNotificationSounds
+	settingsMutex.Unlock()
 
-	// cacheInstance, cacheInstanceOk := cache.InstanceData[instance]
-	orgInstance, orgInstanceOk := org.InstanceData[instance]
+	if !showNotifications {
+		return nc.NotificationResult{}, nil
+	}
 
 	// Determine which icon should be displayed
 	var icon string
-	if orgInstanceOk && orgInstance.NotificationAppIcon != "" {
+	if orgInstance.NotificationAppIcon != "" {
 		icon = orgInstance.NotificationAppIcon
 	} else {
 		if cacheDir, err := settingsManager.CacheDir(); err == nil {
@@ -54,45 +57,49 @@ func sendMessageNotification(instance string, title string, message string, url
 		}
 	}
 
-	notification := toast.Notification{
-		AppID:               "Nextcloud Talk",
-		Title:               title,
-		Message:             message,
-		Audio:               toast.IM,
-		ActivationArguments: url,
-		Icon:                icon,
-		Actions: []toast.Action{
-			{Type: "protocol", Label: "Open", Arguments: url},
-		},
-	}
-
 	// Determine whether the user wants audio for this instance
-	if !user.PlayNotificationSounds || !playAudio {
-		notification.Audio = toast.Silent
-	}
+	playAudio := playSounds && n.PlayAudio
 
-	if err = notification.Push(); err != nil {
-		return err
+	handle, err := notifications.push(n, icon, playAudio)
+	if err != nil {
+		return nc.NotificationResult{}, err
 	}
 
-	return nil
+	return nc.NotificationResult{Handle: handle}, nil
 }
 
-func startNextcloudMonitor(wg *sync.WaitGroup, closeChan chan interface{}) error {
-	for instanceName := range org.InstanceData {
+func withdrawMessageNotification(instance string, handle nc.NotificationHandle) error {
+	return notifications.withdraw(handle)
+}
 
-		// Run the actual Monitor loop
-		wg.Add(1)
-		internalMonitor := newMonitorProc(instanceName)
-		go internalMonitor.run(wg, closeChan)
+func startNextcloudMonitor(wg *sync.WaitGroup, closeChan chan interface{}, menus map[string]*accountMenu) error {
+	for _, ref := range configuredAccounts() {
+		startAccountMonitor(ref, menus[ref.key()], wg, closeChan)
 	}
 
 	return nil
 }
 
-func main() {
+func startAccountMonitor(ref accountRef, menu *accountMenu, wg *sync.WaitGroup, closeChan chan interface{}) {
+	select {
+	case <-closeChan:
+		// Quitting: the shutdown may already be waiting for the monitors.
+		return
+	default:
+	}
+
+	// Run the actual Monitor loop, restarted if it crashes
+	wg.Add(1)
+	go superviseMonitor(ref, menu, wg, closeChan)
+}
+
+// Loads the three configuration layers, and fills in the defaults of every account.
+func loadSettings() error {
 	var err error
 
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
 	settingsManager = settings.NewSettingsManager(
 		"SGH",
 		"GoTalk",
@@ -112,8 +119,7 @@ func main() {
 	)
 
 	if cache, user, org, err = settingsManager.Load(); err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
 
 	if cache.InstanceData == nil {
@@ -128,33 +134,49 @@ func main() {
 		org.InstanceData = make(map[string]OrgInstanceSettings)
 	}
 
-	for instanceName := range org.InstanceData {
-		if _, ok := user.InstanceData[instanceName]; !ok {
-			// Sensible default user settings for a new instance
-			user.InstanceData[instanceName] = UserInstanceSettings{
-				NotificationSettings: nc.NotificationSettings{
-					ShowUserNotifications:    true,
-					ShowGroupNotifications:   true,
-					ShowBotNotifications:     true,
-					ShowGuestNotifications:   true,
-					ShowBridgedNotifications: true,
-					ShowMutedNotifications:   false,
-					PlayNotificationSounds:   true,
-				},
-			}
+	if migrateUserSettings(user) {
+		if err = settingsManager.SaveUser(user); err != nil {
+			log.Print(err)
 		}
+	}
 
-		if _, ok := cache.InstanceData[instanceName]; !ok {
-			cache.InstanceData[instanceName] = InstanceCache{}
-		}
+	for _, ref := range configuredAccountsLocked() {
+		initAccountSettings(ref)
 	}
 
-	defer func() {
-		if err := settingsManager.Save(cache, user, org); err != nil {
-			log.Fatal(err)
-			return
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		// Subcommands run without the tray.
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	if err := loadSettings(); err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	lock, err := acquireInstanceLock()
+	if errors.Is(err, errAlreadyRunning) {
+		// Autostart plus a manual click: the first one keeps running.
+		if output, err := forwardCommand(nil); err != nil {
+			log.Print(err)
+		} else {
+			log.Print(output)
 		}
-	}()
+		return
+	} else if err != nil {
+		// Better two trays than none.
+		log.Print(err)
+	}
+	defer lock.release()
+
+	// Notification actions come back through gotalk:// URIs.
+	if err := registerURIScheme(); err != nil {
+		log.Print(err)
+	}
 
 	var icon fyne.Resource
 
@@ -166,130 +188,79 @@ func main() {
 
 	a := app.New()
 
-	if desk, ok := a.(desktop.App); ok {
-		// Compute a sorted list of all the available instances
-		availableInstances := make([]string, 0, len(org.InstanceData))
-		for k := range org.InstanceData {
-			availableInstances = append(availableInstances, k)
-		}
-		sort.Strings(availableInstances)
+	var wg sync.WaitGroup
+	var closeChan chan interface{} = make(chan interface{})
+
+	// Tray submenus of every account, read by the monitors
+	menus := make(map[string]*accountMenu)
+
+	// Guards the tray menu and lastMenus, changed from the tray and from the Add Account window,
+	// and keeps monitors from starting once quitting began.
+	var trayMutex sync.Mutex
 
+	if desk, ok := a.(desktop.App); ok {
 		// Create the main menu
 		var menu *fyne.Menu = fyne.NewMenu("GoTalk")
 
-		// Create the various submenus
-		for _, instance := range availableInstances {
-			var openInstance *fyne.MenuItem
-			var showUserNotifications *fyne.MenuItem
-			var showGroupNotifications *fyne.MenuItem
-			var showBotNotifications *fyne.MenuItem
-			var showGuestNotifications *fyne.MenuItem
-			var showBridgedNotifications *fyne.MenuItem
-			var showMutedNotifications *fyne.MenuItem
-			var playNotificationSounds *fyne.MenuItem
-
-			updateSettings := func() {
-				data := user.InstanceData[instance]
-				data.NotificationSettings.ShowUserNotifications = showUserNotifications.Checked
-				data.NotificationSettings.ShowGroupNotifications = showGroupNotifications.Checked
-				data.NotificationSettings.ShowBotNotifications = showBotNotifications.Checked
-				data.NotificationSettings.ShowGuestNotifications = showGuestNotifications.Checked
-				data.NotificationSettings.ShowBridgedNotifications = showBridgedNotifications.Checked
-				data.NotificationSettings.ShowMutedNotifications = showMutedNotifications.Checked
-				data.NotificationSettings.PlayNotificationSounds = playNotificationSounds.Checked
-				user.InstanceData[instance] = data
-
-				settingsManager.Save(cache, user, org)
-			}
+		// Last submenu of each instance, new accounts go right after it
+		lastMenus := make(map[string]*fyne.MenuItem)
 
-			openInstance = fyne.NewMenuItem("Open", func() {
-				browser.OpenURL(org.InstanceData[instance].InstanceURL)
-			})
-			showUserNotifications = fyne.NewMenuItem("Show User Notifications", func() {
-				showUserNotifications.Checked = !showUserNotifications.Checked
-				updateSettings()
-				menu.Refresh()
-			})
-			showGroupNotifications = fyne.NewMenuItem("Show Group Notifications", func() {
-				showGroupNotifications.Checked = !showGroupNotifications.Checked
-				updateSettings()
-				menu.Refresh()
-			})
-			showBotNotifications = fyne.NewMenuItem("Show Bot Notifications", func() {
-				showBotNotifications.Checked = !showBotNotifications.Checked
-				updateSettings()
-				menu.Refresh()
-			})
-			showGuestNotifications = fyne.NewMenuItem("Show Guest Notifications", func() {
-				showGuestNotifications.Checked = !showGuestNotifications.Checked
-				updateSettings()
-				menu.Refresh()
-			})
-			showBridgedNotifications = fyne.NewMenuItem("Show Bridged Notifications", func() {
-				showBridgedNotifications.Checked = !showBridgedNotifications.Checked
-				updateSettings()
-				menu.Refresh()
-			})
-			showMutedNotifications = fyne.NewMenuItem("Show Muted Notifications", func() {
-				showMutedNotifications.Checked = !showMutedNotifications.Checked
-				updateSettings()
-				menu.Refresh()
-			})
-			playNotificationSounds = fyne.NewMenuItem("Play Notification Sounds", func() {
-				playNotificationSounds.Checked = !playNotificationSounds.Checked
-				updateSettings()
-				menu.Refresh()
-			})
+		// The primary account comes first and stays: the submenu before a removed one belongs to the same instance.
+		onAccountRemoved := func(m *accountMenu) {
+			trayMutex.Lock()
+			defer trayMutex.Unlock()
 
-			data := user.InstanceData[instance]
-			showUserNotifications.Checked = data.NotificationSettings.ShowUserNotifications
-			showGroupNotifications.Checked = data.NotificationSettings.ShowGroupNotifications
-			showBotNotifications.Checked = data.NotificationSettings.ShowBotNotifications
-			showGuestNotifications.Checked = data.NotificationSettings.ShowGuestNotifications
-			showBridgedNotifications.Checked = data.NotificationSettings.ShowBridgedNotifications
-			showMutedNotifications.Checked = data.NotificationSettings.ShowMutedNotifications
-			playNotificationSounds.Checked = data.NotificationSettings.PlayNotificationSounds
-
-			submenu := fyne.NewMenuItem(instance, func() {})
-			submenu.ChildMenu = fyne.NewMenu(
-				instance,
-				openInstance,
-				fyne.NewMenuItemSeparator(),
-				showUserNotifications,
-				showGroupNotifications,
-				showBotNotifications,
-				showGuestNotifications,
-				showBridgedNotifications,
-				fyne.NewMenuItemSeparator(),
-				showMutedNotifications,
-				playNotificationSounds,
-			)
-
-			coreItems := submenu.ChildMenu.Items
-			loginItem := fyne.NewMenuItem("Log In", func() {})
-
-			inst := org.InstanceData[instance]
-			inst.setInstanceLoginMenuOption = func(callback func()) {
-				if callback == nil {
-					loginItem.Action = nil
-					submenu.ChildMenu.Items = coreItems
-					menu.Refresh()
-				} else {
-					submenu.ChildMenu.Items = coreItems
-					loginItem.Action = callback
-					submenu.ChildMenu.Items = append(submenu.ChildMenu.Items, loginItem)
-					menu.Refresh()
+			idx := slices.Index(menu.Items, m.submenu)
+			for instance, last := range lastMenus {
+				if last == m.submenu && idx > 0 {
+					lastMenus[instance] = menu.Items[idx-1]
 				}
 			}
-			org.InstanceData[instance] = inst
+			m.remove()
+		}
+
+		onAccountAdded := func(ref accountRef) {
+			trayMutex.Lock()
+			defer trayMutex.Unlock()
+
+			m := newAccountMenu(ref, menu, nil, onAccountRemoved)
+			m.insertAt(slices.Index(menu.Items, lastMenus[ref.instance]) + 1)
+			lastMenus[ref.instance] = m.submenu
+			startAccountMonitor(ref, m, &wg, closeChan)
+		}
 
-			menu.Items = append(menu.Items, submenu)
+		// Create the various submenus
+		for _, ref := range configuredAccounts() {
+			m := newAccountMenu(ref, menu, onAccountAdded, onAccountRemoved)
+			menus[ref.key()] = m
+			lastMenus[ref.instance] = m.submenu
+			menu.Items = append(menu.Items, m.submenu)
+		}
+
+		// New instances go after every other submenu, right before this item
+		if org.UserInstances != UserInstancesForbidden {
+			var addInstance *fyne.MenuItem
+			addInstance = fyne.NewMenuItem("Add Account...", func() {
+				showAddInstanceWindow(func(ref accountRef) {
+					trayMutex.Lock()
+					defer trayMutex.Unlock()
+
+					m := newAccountMenu(ref, menu, onAccountAdded, onAccountRemoved)
+					m.insertAt(slices.Index(menu.Items, addInstance))
+					lastMenus[ref.instance] = m.submenu
+					startAccountMonitor(ref, m, &wg, closeChan)
+				})
+			})
+			menu.Items = append(menu.Items, fyne.NewMenuItemSeparator(), addInstance)
 		}
 
 		var showNotifications *fyne.MenuItem
 		var playNotificationSounds *fyne.MenuItem
 
 		updateSettings := func() {
+			settingsMutex.Lock()
+			defer settingsMutex.Unlock()
+
 			user.ShowNotifications = showNotifications.Checked
 			user.PlayNotificationSounds = playNotificationSounds.Checked
 
@@ -308,8 +279,10 @@ func main() {
 			menu.Refresh()
 		})
 
+		settingsMutex.Lock()
 		showNotifications.Checked = user.ShowNotifications
 		playNotificationSounds.Checked = user.PlayNotificationSounds
+		settingsMutex.Unlock()
 
 		menu.Items = append(
 			menu.Items,
@@ -322,21 +295,38 @@ func main() {
 		desk.SetSystemTrayIcon(icon)
 	}
 
-	var wg sync.WaitGroup
-	var closeChan chan interface{} = make(chan interface{})
-
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := startNextcloudMonitor(&wg, closeChan)
+		err := startNextcloudMonitor(&wg, closeChan, menus)
 		if err != nil {
 			log.Print(err)
 			a.Quit()
+			return
 		}
+		startWakeDetection(closeChan)
 	}()
 
-	defer systray.Quit()
-	defer close(closeChan)
+	// Quitting from a terminal or the session manager is like quitting from the tray.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		a.Quit()
+	}()
 
 	a.Run()
+
+	// The monitors write the settings too: stop them first, then save once.
+	trayMutex.Lock()
+	close(closeChan)
+	trayMutex.Unlock()
+	waitForMonitors(&wg, shutdownTimeout)
+	systray.Quit()
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	if err := settingsManager.Save(cache, user, org); err != nil {
+		log.Fatal(err)
+	}
 }
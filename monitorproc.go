@@ -2,135 +2,609 @@ package main
 
 import (
 	"GoTalk/nc"
+	"context"
 	"errors"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/pkg/browser"
 )
 
 type monitorProcData struct {
-	instanceName string
-	ncInstance   *nc.Instance
-	ncMonitor    *nc.Monitor
-	cache        InstanceCache
-	org          OrgInstanceSettings
-	user         UserInstanceSettings
+	account    accountRef   // Instance and account being monitored
+	accountKey string       // Key of the account in the user settings and cache, also its name in the tray
+	menu       *accountMenu // Tray submenu of the account, nil without a tray
+	ncInstance *nc.Instance
+	ncMonitor  *nc.Monitor
+	cache      InstanceCache
+	org        OrgInstanceSettings
+	user       UserInstanceSettings
+
+	poll        pollScheduler // Picks the time between two message checks
+	errorStatus string        // Status line shown for the last error, if any
+
+	backoff   backoffPolicy
+	failures  int           // Consecutive failed requests, drives the backoff
+	retryChan chan struct{} // Cuts the current wait short
+
+	logoutChan      chan struct{} // Log out requests from the tray
+	logoutRequested bool          // A log out request is waiting to be handled
+	loggedOut       bool          // The user logged out, or the device was wiped: only log in from the tray
+
+	unattendedLogins int // Consecutive login prompts that expired without an answer
+
+	promptMutex sync.Mutex          // Guards prompt and loginOption, which are updated from the login flow goroutine
+	prompt      loginPrompt         // What the login strategy currently shows
+	loginOption func(LoginStrategy) // Starts the login the monitor waits for, with its own strategy or the given one
+
+	baseURLChan    chan string // New base URLs accepted from the tray
+	pendingBaseURL string      // A new base URL is waiting to be applied
+
+	actionChan     chan conversationAction // Actions clicked in notifications
+	pendingActions []conversationAction    // Actions waiting for the monitor to be logged in
+
+	queryChan      chan monitorQuery // Requests forwarded by other invocations, e.g. "GoTalk rooms"
+	pendingQueries []monitorQuery    // Requests waiting for the monitor to be logged in
+
+	removeChan chan struct{} // "Remove Account" from the tray
+	removed    atomic.Bool   // The account was removed: log out and forget it once the loop ends
+
+	diagMutex sync.Mutex // Guards diag, which is read from the tray
+	diag      monitorDiagnostics
+
+	progressMutex    sync.Mutex // Guards progressDeadline, which is read by the watchdog
+	progressDeadline time.Time  // When the loop is expected to move on, zero while it waits for the user
+
+	tasks sync.WaitGroup // Login flow goroutines, which must end before the monitor does
 }
 
 type LoginFlowResult int64
 
 const (
-	LoginFlowCanceledOrTimeout LoginFlowResult = iota
+	LoginFlowCanceled LoginFlowResult = iota
 	LoginFlowError
 	LoginFlowSuccessful
+	LoginFlowExpired // Nobody answered the login prompt in time
+)
+
+type loginFlowOutcome struct {
+	LoginFlowResult
+	nc.AuthCredentials
+}
+
+var (
+	monitorsMutex sync.Mutex
+	monitors      = make(map[string]*monitorProcData)
 )
 
-func newMonitorProc(instanceName string) monitorProcData {
-	return monitorProcData{
-		instanceName: instanceName,
+func newMonitorProc(account accountRef, menu *accountMenu) *monitorProcData {
+	p := &monitorProcData{
+		account:     account,
+		accountKey:  account.key(),
+		menu:        menu,
+		retryChan:   make(chan struct{}, 1),
+		logoutChan:  make(chan struct{}, 1),
+		baseURLChan: make(chan string, 1),
+		actionChan:  make(chan conversationAction, 8),
+		queryChan:   make(chan monitorQuery, 4),
+		removeChan:  make(chan struct{}, 1),
 	}
+
+	monitorsMutex.Lock()
+	monitors[p.accountKey] = p
+	monitorsMutex.Unlock()
+
+	return p
 }
 
-func (p *monitorProcData) readCredentials() nc.AuthCredentials {
-	var decPassword string
-	var err error
-	if decPassword, err = crypto_decrypt(p.cache.EncryptedAppPassword); err != nil {
-		decPassword = ""
+// Asks the monitor of an account to stop waiting and check right away.
+func retryMonitor(accountKey string) {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if ok {
+		p.retryNow()
+	}
+}
+
+func retryAllMonitors() {
+	monitorsMutex.Lock()
+	defer monitorsMutex.Unlock()
+
+	for _, p := range monitors {
+		p.retryNow()
+	}
+}
+
+// Asks the monitor of an account to log out.
+func logoutMonitor(accountKey string) {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if ok {
+		select {
+		case p.logoutChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Hands an action clicked in a notification to the monitor of an account.
+func queueMonitorAction(accountKey string, action conversationAction) error {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if !ok {
+		return errors.New(accountKey + " isn't monitored")
+	}
+	select {
+	case p.actionChan <- action:
+		return nil
+	default:
+		return errors.New(accountKey + " has too many pending actions")
+	}
+}
+
+// Stops the monitor of an additional account, which then logs out and forgets the account.
+func removeMonitor(ref accountRef) error {
+	monitorsMutex.Lock()
+	p, ok := monitors[ref.key()]
+	monitorsMutex.Unlock()
+
+	if !ok {
+		// Waiting to restart after a crash: there's no login to revoke.
+		return removeAccount(ref)
+	}
+	select {
+	case p.removeChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// A request run by the monitor loop, which owns the instance of the account.
+type monitorQuery func(ctx context.Context, p *monitorProcData)
+
+// Runs a request with the instance of a logged in account, on its monitor loop.
+func queueMonitorQuery(accountKey string, query monitorQuery) error {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if !ok {
+		return errors.New(accountKey + " isn't monitored")
+	}
+	if p.diagnostics().Login != loginStateLoggedIn {
+		return errors.New(accountKey + " isn't logged in")
+	}
+	select {
+	case p.queryChan <- query:
+		return nil
+	default:
+		return errors.New(accountKey + " has too many pending requests")
+	}
+}
+
+// Starts the login that the monitor of an account waits for, presenting it with the given strategy.
+func loginMonitor(accountKey string, strategy LoginStrategy) error {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if !ok {
+		return errors.New(accountKey + " isn't monitored")
+	}
+	login := p.takeLoginOption()
+	if login == nil {
+		return errors.New(accountKey + " doesn't wait for a login: it's logged in, or its login is already pending")
 	}
+	login(strategy)
+	return nil
+}
+
+// Returns the login page of the login flow pending for an account, if any.
+func pendingLoginURL(accountKey string) (string, bool) {
+	monitorsMutex.Lock()
+	p, ok := monitors[accountKey]
+	monitorsMutex.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	loginURL := p.pendingLoginURL()
+	return loginURL, loginURL != ""
+}
+
+// Extra time allowed on top of every expected wait
+const progressGrace = time.Minute
+
+// Tells the watchdog that the loop will move on within the given time.
+func (p *monitorProcData) expectProgress(within time.Duration) {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	p.progressDeadline = time.Now().Add(within + progressGrace)
+}
 
+// Tells the watchdog that the loop waits for the user, for as long as it takes.
+func (p *monitorProcData) waitForUser() {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	p.progressDeadline = time.Time{}
+}
+
+func (p *monitorProcData) stalled() bool {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	return !p.progressDeadline.IsZero() && time.Now().After(p.progressDeadline)
+}
+
+// Returns the accounts whose loop didn't move on in time.
+func stalledMonitors() []string {
+	monitorsMutex.Lock()
+	defer monitorsMutex.Unlock()
+
+	var stalled []string
+	for key, p := range monitors {
+		if p.stalled() {
+			stalled = append(stalled, key)
+		}
+	}
+	return stalled
+}
+
+// Longest time a check may take: a handful of requests, each with all of its retries.
+func (p *monitorProcData) checkBudget() time.Duration {
+	settings := p.org.httpSettings().WithDefaults()
+	request := settings.RequestTimeout
+	delay := settings.RetryDelay
+	for range settings.MaxRetries {
+		request += delay + settings.RequestTimeout
+		delay *= 2
+	}
+	return request * 5
+}
+
+func (p *monitorProcData) retryNow() {
+	select {
+	case p.retryChan <- struct{}{}:
+	default:
+		// A retry is already pending.
+	}
+}
+
+// Waits for the given delay, or until a retry or a log out is requested.
+// Returns false if the app is quitting.
+func (p *monitorProcData) wait(delay time.Duration, closeChan chan interface{}) bool {
+	p.expectProgress(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-p.retryChan:
+		return true
+	case <-p.logoutChan:
+		p.logoutRequested = true
+		return true
+	case url := <-p.baseURLChan:
+		p.pendingBaseURL = url
+		return true
+	case action := <-p.actionChan:
+		p.pendingActions = append(p.pendingActions, action)
+		return true
+	case query := <-p.queryChan:
+		p.pendingQueries = append(p.pendingQueries, query)
+		return true
+	case <-closeChan:
+		return false
+	}
+}
+
+// Secrets that can't be decrypted, e.g. after moving the cache to another machine, read as empty.
+func decryptSecret(encrypted string) string {
+	if encrypted == "" {
+		return ""
+	}
+	decrypted, err := crypto_decrypt(encrypted)
+	if err != nil {
+		return ""
+	}
+	return decrypted
+}
+
+func encryptSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	return crypto_encrypt(secret)
+}
+
+func (p *monitorProcData) readCredentials() nc.AuthCredentials {
 	return nc.AuthCredentials{
-		LoginName:   p.cache.Username,
-		AppPassword: decPassword,
+		LoginName:         p.cache.Username,
+		AppPassword:       decryptSecret(p.cache.EncryptedAppPassword),
+		AccessToken:       decryptSecret(p.cache.EncryptedAccessToken),
+		RefreshToken:      decryptSecret(p.cache.EncryptedRefreshToken),
+		AccessTokenExpiry: p.cache.AccessTokenExpiry,
 	}
 }
 
 func (p *monitorProcData) saveCredentials(cred nc.AuthCredentials) {
+	appPassword, err := encryptSecret(cred.AppPassword)
+	if err != nil {
+		return
+	}
+	accessToken, err := encryptSecret(cred.AccessToken)
+	if err != nil {
+		return
+	}
+	refreshToken, err := encryptSecret(cred.RefreshToken)
+	if err != nil {
+		return
+	}
+
 	p.cache.Username = cred.LoginName
-	p.cache.EncryptedAppPassword = ""
+	p.cache.EncryptedAppPassword = appPassword
+	p.cache.EncryptedAccessToken = accessToken
+	p.cache.EncryptedRefreshToken = refreshToken
+	p.cache.AccessTokenExpiry = cred.AccessTokenExpiry
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	cache.InstanceData[p.accountKey] = p.cache
+	settingsManager.Save(cache, user, org)
+}
 
-	if cred.AppPassword != "" {
-		s, err := crypto_encrypt(cred.AppPassword)
-		if err != nil {
-			return
+func (p *monitorProcData) getNotificationSettings() nc.NotificationSettings {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return user.InstanceData[p.accountKey].NotificationSettings
+}
+
+func (p *monitorProcData) sendNotification(notification nc.Notification) (nc.NotificationResult, error) {
+	if hasSeveralAccounts(p.account.instance) {
+		notification.Account = p.accountKey
+	}
+	if notification.ConversationToken != "" && notification.Actions == nil {
+		// Routed back to GoTalk through its URI scheme.
+		notification.Actions = []nc.NotificationAction{
+			{Label: "Mark as Read", URL: actionURI(uriRead, p.accountKey, notification.ConversationToken)},
+			{Label: "Snooze 1 Hour", URL: actionURI(uriSnooze, p.accountKey, notification.ConversationToken)},
 		}
-		p.cache.EncryptedAppPassword = s
 	}
+	return sendMessageNotification(notification, p.org)
+}
 
-	cache.InstanceData[p.instanceName] = p.cache
-	settingsManager.Save(cache, user, org)
+func (p *monitorProcData) withdrawNotification(instance string, handle nc.NotificationHandle) error {
+	return withdrawMessageNotification(instance, handle)
 }
 
-func (p *monitorProcData) getNotificationSettings() nc.NotificationSettings {
-	return user.InstanceData[p.instanceName].NotificationSettings
+func (p *monitorProcData) sendLoginNotification(url string) error {
+	_, err := p.sendNotification(nc.Notification{
+		Instance:  p.accountKey,
+		Title:     p.accountKey,
+		Message:   "Login to NextCloud",
+		URL:       url,
+		PlayAudio: true,
+		Urgency:   nc.UrgencyCritical,
+		Category:  nc.CategoryLogin,
+	})
+	return err
+}
+
+// Clicking it starts the login through the gotalk:// URI scheme, like "Log In" in the tray.
+func (p *monitorProcData) sendLoginRequiredNotification() error {
+	_, err := p.sendNotification(nc.Notification{
+		Instance: p.accountKey,
+		Title:    p.accountKey,
+		Message:  "Login required, click to log in to NextCloud",
+		URL:      actionURI(uriLogin, p.accountKey, ""),
+		Urgency:  nc.UrgencyNormal,
+		Category: nc.CategoryLogin,
+	})
+	return err
 }
 
-func (p *monitorProcData) sendNotification(instance string, title string, message string, url string, playAudio bool) error {
-	return sendMessageNotification(instance, title, message, url, playAudio)
+func (p *monitorProcData) setStatus(status string) {
+	p.menu.setStatus(status)
 }
 
-func (p *monitorProcData) run(wg *sync.WaitGroup, closeChan chan interface{}) {
-	defer wg.Done()
+// Shows the outcome of the last request in the tray menu.
+// Certificate errors won't go away on their own, so they're also reported with a notification.
+func (p *monitorProcData) updateErrorState(err error) {
+	status := ""
+	if err != nil {
+		switch nc.ErrorKindOf(err) {
+		case nc.ErrorNetwork:
+			status = "Server unreachable"
+		case nc.ErrorCertificate:
+			status = "Certificate error"
+		case nc.ErrorMaintenance:
+			status = "Server in maintenance"
+		case nc.ErrorRateLimited:
+			status = "Throttled by the server"
+		case nc.ErrorForbidden:
+			status = "Access denied"
+		case nc.ErrorNotFound:
+			status = "Nextcloud Talk is not available"
+		}
+	}
 
-	p.cache = cache.InstanceData[p.instanceName]
-	p.org = org.InstanceData[p.instanceName]
-	p.user = user.InstanceData[p.instanceName]
+	if status == p.errorStatus {
+		return
+	}
+	p.errorStatus = status
+	p.setStatus(status)
 
-	p.ncInstance = nc.NewInstance(p.instanceName, p.org.InstanceURL)
+	if nc.ErrorKindOf(err) != nc.ErrorCertificate || err == nil {
+		return
+	}
+	p.sendNotification(nc.Notification{
+		Instance:  p.accountKey,
+		Title:     p.accountKey,
+		Message:   "The server certificate was rejected: " + err.Error(),
+		URL:       p.org.InstanceURL,
+		PlayAudio: true,
+		Urgency:   nc.UrgencyCritical,
+		Category:  nc.CategoryError,
+	})
+}
+
+// Reads the settings of the account, then prepares its instance and monitor.
+// Fails when the TLS or proxy settings can't be applied: the account must not fall back to
+// the system trust store or to direct connections.
+func (p *monitorProcData) setup() error {
+	settingsMutex.Lock()
+	p.cache = cache.InstanceData[p.accountKey]
+	p.org, _ = instanceSettingsLocked(p.account.instance)
+	p.user = user.InstanceData[p.accountKey]
+	effectiveURL := user.InstanceData[p.account.instance].EffectiveInstanceURL
+	messageCheckTime := org.MessageCheckTime
+	watchlistEntries := user.Watchlist
+	settingsMutex.Unlock()
+
+	p.ncInstance = nc.NewInstance(p.accountKey, p.org.InstanceURL)
+	p.ncInstance.SetTrustedAliases(p.org.InstanceAliases)
+	p.ncInstance.SetOAuth2Config(p.org.oauth2Config())
+	if effectiveURL != "" {
+		// Only follow a moved instance to a host the organization still trusts.
+		if url, err := p.ncInstance.CheckTrustedURL(effectiveURL); err == nil {
+			p.ncInstance.SetBaseURL(url)
+		} else {
+			log.Print(err)
+		}
+	}
+	if err := p.ncInstance.SetHTTPSettings(p.org.httpSettings()); err != nil {
+		return errors.New("invalid connection settings: " + err.Error())
+	}
+	if p.org.ProxyPAC != "" && p.org.ProxyURL == "" && !nc.PACSupported {
+		log.Printf("%s: ProxyPAC is only supported on Windows, using the proxy environment variables instead", p.accountKey)
+	}
 	p.ncInstance.SetCredentials(p.readCredentials())
 	p.ncInstance.OnCredentialsUpdated(p.saveCredentials)
 
 	p.ncMonitor = nc.NewMonitor(p.ncInstance, p.org.NotificationRepeatTime)
 	p.ncMonitor.SetNotificationSettingsGetter(p.getNotificationSettings)
 	p.ncMonitor.SetNotificationSender(p.sendNotification)
+	p.ncMonitor.SetNotificationWithdrawer(p.withdrawNotification)
+	p.ncMonitor.SetNotificationCountSetter(p.updateCounts)
+	p.ncMonitor.SetDigestThreshold(uint(p.org.DigestThreshold))
 
-	messageCheckTime := org.MessageCheckTime
-	if messageCheckTime <= 5 {
-		messageCheckTime = 5
+	watchlist, err := nc.CompileWatchlist(watchlistEntries)
+	if err != nil {
+		log.Print(err)
 	}
+	p.ncMonitor.SetWatchlist(watchlist)
+
+	p.poll = p.org.pollScheduler(messageCheckTime)
+	p.backoff = p.org.backoffPolicy()
+	return nil
+}
+
+// Runs the monitor until quitChan is closed, or until the account is removed.
+func (p *monitorProcData) run(quitChan chan interface{}) {
+	// A removed account is forgotten once nothing else uses its instance.
+	defer func() {
+		if p.removed.Load() {
+			p.remove()
+		}
+	}()
+
+	// Login flow goroutines end once the context is canceled: wait for them last.
+	defer p.tasks.Wait()
 
+	// Canceling this context aborts any in-flight request and pending login flow once the app is quitting,
+	// or once the account is removed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	closeChan := make(chan interface{})
+	go func() {
+		select {
+		case <-quitChan:
+		case <-p.removeChan:
+			p.removed.Store(true)
+		case <-ctx.Done():
+			return
+		}
+		close(closeChan)
+		cancel()
+	}()
+
+	// The watchdog stops looking at this account once its loop ends.
+	defer func() {
+		monitorsMutex.Lock()
+		defer monitorsMutex.Unlock()
+		if monitors[p.accountKey] == p {
+			delete(monitors, p.accountKey)
+		}
+	}()
+
+	if err := p.setup(); err != nil {
+		// Nothing is sent to the server until the configuration is fixed.
+		log.Print(p.accountKey + ": " + err.Error())
+		p.updateSetupError(err)
+		p.setStatus("Invalid connection settings")
+		p.sendNotification(nc.Notification{
+			Instance:  p.accountKey,
+			Title:     p.accountKey,
+			Message:   "Not monitored: " + err.Error(),
+			PlayAudio: true,
+			Urgency:   nc.UrgencyCritical,
+			Category:  nc.CategoryError,
+		})
+		p.waitForUser()
+		<-closeChan
+		return
+	}
 	shouldLogin := true
 
 LoginCheck:
 	for {
-		result, resp, err := p.handleFirstLoginCheck()
+		p.expectProgress(p.checkBudget())
+		result, err := p.handleFirstLoginCheck(ctx)
 
 		if err != nil {
 			log.Print(err)
 		}
+		p.updateErrorState(err)
 
-		switch resp {
-		case nc.APIMaintenance:
-			// Nextcloud is in maintenance: Wait 5 minutes and retry.
-			select {
-			case <-time.After(time.Minute * 5):
-			case <-closeChan:
-				break LoginCheck
-			}
-		case nc.APIUnreachable:
-			// Nextcloud is unreachable: Wait 5 minutes and retry.
-			select {
-			case <-time.After(time.Minute * 5):
-			case <-closeChan:
-				break LoginCheck
+		if err == nil {
+			if result == nc.CredentialsExpired {
+				p.checkRemoteWipe(ctx)
 			}
-		case nc.APISuccess:
+
 			// Request successful, but should we login?
 			shouldLogin = !(result == nc.CredentialsValid)
 			break LoginCheck
-		case nc.APILoginExpired:
+		} else if nc.ErrorKindOf(err) == nc.ErrorLoginExpired {
 			// The login expired somehow.
 			// This shouldn't happen, but if it does...
 			shouldLogin = true
 			break LoginCheck
 		}
+
+		if !p.wait(p.retryDelay(err), closeChan) {
+			break LoginCheck
+		}
+
+		if p.logoutRequested {
+			p.logout(ctx)
+			shouldLogin = true
+			break LoginCheck
+		}
 	}
 
-	defer p.org.setInstanceLoginMenuOption(nil)
+	defer p.setLoginOption(nil)
 
 RunLoop:
 	for {
+		p.expectProgress(p.checkBudget())
+
 		// First of all, check if the app is quitting.
 		select {
 		case <-closeChan:
@@ -140,18 +614,16 @@ RunLoop:
 
 		// Should we login?
 		if shouldLogin {
-			chanWaitLogin, resp, err := p.handleLoginRequired()
+			p.updateLoginState(loginStateLoggedOut)
+			chanWaitLogin, err := p.handleLoginRequired(ctx)
 
 			if err != nil {
 				log.Print(err)
-			}
+				p.updateErrorState(err)
 
-			if resp != nc.APISuccess {
 				// Error trying to start the Login Flow:
 				// Retry in a bit.
-				select {
-				case <-time.After(time.Minute * 5):
-				case <-closeChan:
+				if !p.wait(p.retryDelay(err), closeChan) {
 					break RunLoop
 				}
 				continue
@@ -161,333 +633,265 @@ RunLoop:
 			// Alternative: The app is quitting, get out.
 			select {
 			case result, ok := <-chanWaitLogin:
-				if ok {
-					if result.LoginFlowResult == LoginFlowSuccessful {
-						shouldLogin = false
-						p.ncInstance.SetCredentials(result.AuthCredentials)
-					} else {
+				if !ok {
+					break
+				}
+
+				switch result.LoginFlowResult {
+				case LoginFlowSuccessful:
+					if other, ok := duplicateLogin(p.account, result.AuthCredentials.LoginName); ok {
+						p.rejectLogin(ctx, result.AuthCredentials, other)
 						shouldLogin = true
+						break
+					}
+
+					shouldLogin = false
+					p.loggedOut = false
+					p.unattendedLogins = 0
+					p.ncInstance.SetCredentials(result.AuthCredentials)
+
+					// Drop any log out request made before this login.
+					select {
+					case <-p.logoutChan:
+					default:
 					}
+				case LoginFlowExpired:
+					shouldLogin = true
+					if !p.remindLogin(closeChan) {
+						break RunLoop
+					}
+				default:
+					shouldLogin = true
 				}
 			case <-closeChan:
 				break RunLoop
 			}
-			p.org.setInstanceLoginMenuOption(nil)
+			p.setLoginOption(nil)
 		} else {
 			// We're logged in, process our request.
-			resp, err := p.handleLoginSuccessful()
+			p.updateLoginState(loginStateLoggedIn)
+			err := p.handleLoginSuccessful(ctx)
 			if err != nil {
 				log.Print(err)
 			}
+			p.updateErrorState(err)
 
-			switch resp {
-			case nc.APILoginExpired:
+			if err != nil && nc.ErrorKindOf(err) == nc.ErrorLoginExpired {
 				// We got logged out. Try logging in again, but wait a bit before trying.
+				p.checkRemoteWipe(ctx)
 				shouldLogin = true
-				select {
-				case <-time.After(time.Second * 5):
-				case <-closeChan:
-					break RunLoop
-				}
-			case nc.APIMaintenance:
-				// Nextcloud is in maintenance: Wait 5 minutes and retry.
-				select {
-				case <-time.After(time.Minute * 5):
-				case <-closeChan:
-					break RunLoop
-				}
-			case nc.APIUnreachable:
-				// Nextcloud is unreachable: Wait a bit and retry.
-				select {
-				case <-time.After(time.Second * 20):
-				case <-closeChan:
-					break RunLoop
-				}
-			case nc.APISuccess:
-				// API Request successful: Wait some time before running another request.
-				select {
-				case <-time.After(time.Second * time.Duration(messageCheckTime)):
-				case <-closeChan:
-					break RunLoop
-				}
 			}
-		}
-	}
-}
-
-// Returns false, error in case of error.
-// Returns false, nil in case that the credentials are still valid.
-// Returns true, nil/error case that the credentials expired / are invalid.
-func (p *monitorProcData) handleLoginSuccessful() (nc.APIResponse, error) {
-	status, err := p.ncMonitor.ProcessMessages()
-
-	if status != nc.APISuccess || err != nil {
-		return status, err
-	}
-
-	// Placeholder: Do something?
-
-	return nc.APISuccess, nil
-}
-
-func (p *monitorProcData) handleLoginRequired() (chan struct {
-	LoginFlowResult
-	nc.AuthCredentials
-}, nc.APIResponse, error) {
-	chanLoginFlow := make(chan struct {
-		LoginFlowResult
-		nc.AuthCredentials
-	})
-
-	// Close this login flow right away for convenience.
-	// We're gonna return a valid channel only if the function succeeds.
-	close(chanLoginFlow)
-
-	switch p.org.Login {
-	case LoginImmediately:
-		loginFlow := p.ncInstance.NewLoginFlow()
-		if loginFlow == nil {
-			return chanLoginFlow, nc.APIUnreachable, errors.New("the login flow failed")
-		}
-
-		resp, url, err := loginFlow.Start()
-
-		if resp != nc.APISuccess || err != nil {
-			return chanLoginFlow, resp, err
-		}
 
-		if err = browser.OpenURL(url); err != nil {
-			// Could not open the browser: Send a notification.
-			if err = p.sendNotification(p.instanceName, p.instanceName, "Login to NextCloud", url, true); err != nil {
-				loginFlow.Cancel()
-				return chanLoginFlow, resp, err
+			if !p.wait(p.retryDelay(err), closeChan) {
+				break RunLoop
 			}
-		}
-
-		chanLoginFlow = make(chan struct {
-			LoginFlowResult
-			nc.AuthCredentials
-		})
-
-		go func() {
-			resp, res, cred, err := loginFlow.Wait()
-
-			// Login Flow Canceled / Timeout
-			if resp != nc.APISuccess || err != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowCanceledOrTimeout,
-					nc.AuthCredentials{},
-				}
 
-				close(chanLoginFlow)
-				return
+			if p.logoutRequested {
+				p.logout(ctx)
+				shouldLogin = true
 			}
+			if p.pendingBaseURL != "" {
+				p.ncInstance.SetBaseURL(p.pendingBaseURL)
+				p.pendingBaseURL = ""
+			}
+			if !shouldLogin {
+				// The next check withdraws the notifications these actions dealt with.
+				p.runPendingActions(ctx)
 
-			if res == nc.LoginSuccessful && cred != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowSuccessful,
-					*cred,
-				}
-
-				close(chanLoginFlow)
-				return
-			} else {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowCanceledOrTimeout,
-					nc.AuthCredentials{},
+				for _, query := range p.pendingQueries {
+					query(ctx, p)
 				}
-
-				close(chanLoginFlow)
-				return
+				p.pendingQueries = nil
 			}
-		}()
-
-		return chanLoginFlow, resp, nil
-
-	case LoginWithNotification:
-		loginFlow := p.ncInstance.NewLoginFlow()
-		if loginFlow == nil {
-			return chanLoginFlow, nc.APIUnreachable, errors.New("the login flow failed")
 		}
+	}
+}
 
-		resp, url, err := loginFlow.Start()
-
-		if resp != nc.APISuccess || err != nil {
-			return chanLoginFlow, resp, err
-		}
+// Shows a status line that stays until the next successful request.
+func (p *monitorProcData) setStickyStatus(status string) {
+	p.errorStatus = status
+	p.setStatus(status)
+}
 
-		if err = p.sendNotification(p.instanceName, p.instanceName, "Login to NextCloud", url, true); err != nil {
-			loginFlow.Cancel()
-			return chanLoginFlow, resp, err
-		}
+// Revokes the app password of credentials that the account won't use, leaving its own untouched.
+func (p *monitorProcData) revokeCredentials(ctx context.Context, credentials nc.AuthCredentials) {
+	p.ncInstance.OnCredentialsUpdated(nil)
+	p.ncInstance.SetCredentials(credentials)
+	if err := p.ncInstance.RevokeAppPassword(ctx); err != nil {
+		log.Print(err)
+	}
+	p.ncInstance.SetCredentials(p.readCredentials())
+	p.ncInstance.OnCredentialsUpdated(p.saveCredentials)
+}
 
-		chanLoginFlow = make(chan struct {
-			LoginFlowResult
-			nc.AuthCredentials
-		})
+// Turns down the credentials of a user that another account of the instance already monitors.
+// The browser logs in whoever is signed in there, usually the primary account:
+// the new app password is revoked rather than kept around unused.
+func (p *monitorProcData) rejectLogin(ctx context.Context, credentials nc.AuthCredentials, other accountRef) {
+	p.revokeCredentials(ctx, credentials)
+
+	// Only log in again once the user has seen why.
+	p.loggedOut = true
+	p.setStickyStatus("Same user as " + other.key())
+	p.sendNotification(nc.Notification{
+		Instance:  p.accountKey,
+		Title:     p.accountKey,
+		Message:   duplicateLoginMessage(credentials.LoginName, other),
+		PlayAudio: true,
+		Urgency:   nc.UrgencyCritical,
+		Category:  nc.CategoryLogin,
+	})
+}
 
-		go func() {
-			resp, res, cred, err := loginFlow.Wait()
-
-			// Login Flow Canceled / Timeout
-			if resp != nc.APISuccess || err != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowCanceledOrTimeout,
-					nc.AuthCredentials{},
-				}
+// Logs out of a removed account, then forgets its settings.
+func (p *monitorProcData) remove() {
+	if p.ncMonitor != nil && p.ncInstance.GetCredentials().LoginName != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), p.checkBudget())
+		defer cancel()
+		p.logout(ctx)
+	}
+	if err := removeAccount(p.account); err != nil {
+		log.Print(err)
+	}
+}
 
-				close(chanLoginFlow)
-				return
-			}
+// Revokes the app password on the server, then forgets the credentials.
+func (p *monitorProcData) logout(ctx context.Context) {
+	p.logoutRequested = false
 
-			if res == nc.LoginSuccessful && cred != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowSuccessful,
-					*cred,
-				}
+	if err := p.ncInstance.RevokeAppPassword(ctx); err != nil {
+		// The user asked to log out: forget the credentials anyway.
+		log.Print(err)
+	}
 
-				close(chanLoginFlow)
-				return
-			} else {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowCanceledOrTimeout,
-					nc.AuthCredentials{},
-				}
+	p.ncMonitor.Reset()
+	p.ncInstance.SetCredentials(nc.AuthCredentials{})
+	p.loggedOut = true
+	p.setStickyStatus("Logged out")
+}
 
-				close(chanLoginFlow)
-				return
-			}
-		}()
+// Once the credentials stop working, checks whether an administrator asked to wipe this device.
+// If so, the credentials and cached data of the instance are erased, then the wipe is confirmed.
+func (p *monitorProcData) checkRemoteWipe(ctx context.Context) {
+	wipe, err := p.ncInstance.CheckRemoteWipe(ctx)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !wipe {
+		return
+	}
 
-		return chanLoginFlow, resp, nil
+	p.ncMonitor.Reset()
+	p.cache = InstanceCache{}
+	settingsMutex.Lock()
+	delete(cache.InstanceData, p.accountKey)
+	settingsManager.Save(cache, user, org)
+	settingsMutex.Unlock()
 
-	case LoginWithContextMenu:
-		chanLoginFlow = make(chan struct {
-			LoginFlowResult
-			nc.AuthCredentials
-		})
+	// The confirmation is authenticated with the app password, so it's the last thing to forget.
+	if err := p.ncInstance.ConfirmRemoteWipe(ctx); err != nil {
+		log.Print(err)
+	}
+	p.ncInstance.OnCredentialsUpdated(nil)
+	p.ncInstance.SetCredentials(nc.AuthCredentials{})
+	p.ncInstance.OnCredentialsUpdated(p.saveCredentials)
 
-		p.org.setInstanceLoginMenuOption(func() {
-			loginFlow := p.ncInstance.NewLoginFlow()
-			if loginFlow == nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowError,
-					nc.AuthCredentials{},
-				}
+	p.loggedOut = true
+	p.setStickyStatus("Device wiped")
+	p.sendNotification(nc.Notification{
+		Instance:  p.accountKey,
+		Title:     p.accountKey,
+		Message:   "An administrator wiped this device: the account was logged out.",
+		PlayAudio: true,
+		Urgency:   nc.UrgencyCritical,
+		Category:  nc.CategoryError,
+	})
+}
 
-				close(chanLoginFlow)
-				return
-			}
+// Picks how long to wait before the next request, based on how the last one went.
+// Consecutive failures back off exponentially, following the instance policy.
+// Successful checks follow the adaptive polling interval.
+func (p *monitorProcData) retryDelay(err error) time.Duration {
+	var delay time.Duration
+	switch {
+	case err == nil:
+		p.failures = 0
+		delay = p.poll.next(p.ncMonitor.Activity())
+	case nc.ErrorKindOf(err) == nc.ErrorLoginExpired:
+		// Not a server issue: the login flow takes it from here.
+		p.failures = 0
+		delay = time.Second * 5
+	default:
+		p.failures++
+		delay = p.backoff.delay(p.failures, err)
+	}
 
-			resp, url, err := loginFlow.Start()
+	p.updateDiagnostics(err, delay)
+	return delay
+}
 
-			if resp != nc.APISuccess || err != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowError,
-					nc.AuthCredentials{},
-				}
+// After a domain move, the server advertises its new URL: offer to switch to it.
+// The login flow only reports trusted URLs, so the new one is either the same host or an alias.
+// Every account of the instance follows the switch.
+func (p *monitorProcData) offerServerURL(server string) {
+	if server == "" || strings.EqualFold(server, p.ncInstance.GetBaseURL()) || p.menu == nil {
+		return
+	}
 
-				close(chanLoginFlow)
-				return
-			}
+	p.menu.setURLOffer(server, func() {
+		p.menu.setURLOffer("", nil)
 
-			if err = browser.OpenURL(url); err != nil {
-				// Could not open the browser: Send a notification.
-				if err = p.sendNotification(p.instanceName, p.instanceName, "Login to NextCloud", url, true); err != nil {
-					loginFlow.Cancel()
-					chanLoginFlow <- struct {
-						LoginFlowResult
-						nc.AuthCredentials
-					}{
-						LoginFlowError,
-						nc.AuthCredentials{},
-					}
+		settingsMutex.Lock()
+		data := user.InstanceData[p.account.instance]
+		data.EffectiveInstanceURL = server
+		user.InstanceData[p.account.instance] = data
+		settingsManager.Save(cache, user, org)
+		settingsMutex.Unlock()
 
-					close(chanLoginFlow)
-					return
-				}
+		monitorsMutex.Lock()
+		defer monitorsMutex.Unlock()
+		for _, m := range monitors {
+			if m.account.instance != p.account.instance {
+				continue
 			}
-
-			resp, res, cred, err := loginFlow.Wait()
-
-			// Login Flow Canceled / Timeout
-			if resp != nc.APISuccess || err != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowCanceledOrTimeout,
-					nc.AuthCredentials{},
-				}
-
-				close(chanLoginFlow)
-				return
+			select {
+			case m.baseURLChan <- server:
+			default:
 			}
+		}
+	})
 
-			if res == nc.LoginSuccessful && cred != nil {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowSuccessful,
-					*cred,
-				}
-
-				close(chanLoginFlow)
-				return
-			} else {
-				chanLoginFlow <- struct {
-					LoginFlowResult
-					nc.AuthCredentials
-				}{
-					LoginFlowCanceledOrTimeout,
-					nc.AuthCredentials{},
-				}
+	p.sendNotification(nc.Notification{
+		Instance: p.accountKey,
+		Title:    p.accountKey,
+		Message:  "The server now answers at " + server + ". Use the instance menu to switch to it.",
+		Urgency:  nc.UrgencyLow,
+		Category: nc.CategoryLogin,
+	})
+}
 
-				close(chanLoginFlow)
-				return
-			}
-		})
-		return chanLoginFlow, nc.APISuccess, nil
+// Returns nil if the messages were processed, or the reason why they weren't.
+func (p *monitorProcData) handleLoginSuccessful(ctx context.Context) error {
+	if err := p.ncMonitor.ProcessMessages(ctx); err != nil {
+		return err
 	}
 
-	return chanLoginFlow, nc.APIUnreachable, errors.New("invalid login mode")
+	// Placeholder: Do something?
+
+	return nil
 }
 
-// Returns false, error in case of error.
-// Returns false, nil in case that the credentials are still valid.
-// Returns true, nil in case that the credentials expired / are invalid.
-func (p *monitorProcData) handleFirstLoginCheck() (nc.CredentialValidationResult, nc.APIResponse, error) {
-	result, resp, err := p.ncInstance.ValidateCredentials(p.ncInstance.GetCredentials())
-	if result != nc.CredentialsValid || resp != nc.APISuccess || err != nil {
-		return result, resp, err
+// Returns CredentialsValidationFailed, error in case of error.
+// Returns CredentialsValid, nil in case that the credentials are still valid.
+// Returns CredentialsExpired/CredentialsInvalid, nil in case that the credentials expired / are invalid.
+func (p *monitorProcData) handleFirstLoginCheck(ctx context.Context) (nc.CredentialValidationResult, error) {
+	result, err := p.ncInstance.ValidateCredentials(ctx, p.ncInstance.GetCredentials())
+	if result != nc.CredentialsValid || err != nil {
+		return result, err
 	}
 
 	// Placeholder: Do something?
 
-	return nc.CredentialsValid, nc.APISuccess, nil
+	return nc.CredentialsValid, nil
 }
@@ -0,0 +1,103 @@
+package nc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+type nextcloudWipeCheck struct {
+	Wipe bool `json:"wipe"`
+}
+
+// Deletes the app password of the current credentials on the server.
+// An app password the server doesn't know anymore is considered revoked.
+// OAuth2 tokens can't be revoked by the client: they're left to expire.
+func (i *Instance) RevokeAppPassword(ctx context.Context) error {
+	if i.credentials.IsOAuth2() {
+		return nil
+	}
+
+	req, err := i.NewOCSRequest(ctx, http.MethodDelete, i.baseUrl+"/ocs/v2.php/core/apppassword", bytes.NewReader([]byte("")))
+	if err != nil {
+		return err
+	}
+
+	resp, err := i.do(req)
+	if err != nil {
+		return newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 || resp.StatusCode == 401 {
+		return nil
+	}
+	return newResponseError(resp)
+}
+
+func (i *Instance) newWipeRequest(ctx context.Context, endpoint string) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("token", i.credentials.AppPassword)
+
+	return i.NewRequest(ctx, http.MethodPost, i.baseUrl+"/index.php/core/wipe/"+endpoint, bytes.NewReader([]byte(form.Encode())))
+}
+
+// Asks the server whether an administrator requested to wipe this device.
+// Meant to be called once the credentials stop working.
+func (i *Instance) CheckRemoteWipe(ctx context.Context) (bool, error) {
+	if i.credentials.AppPassword == "" {
+		return false, nil
+	}
+
+	req, err := i.newWipeRequest(ctx, "check")
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := i.do(req)
+	if err != nil {
+		return false, newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return false, nil
+	} else if resp.StatusCode != 200 {
+		return false, newResponseError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, newRequestError(err)
+	}
+
+	ncRes := nextcloudWipeCheck{}
+	if err = json.Unmarshal(body, &ncRes); err != nil {
+		return false, newDecodeError(resp, err)
+	}
+
+	return ncRes.Wipe, nil
+}
+
+// Tells the server that the local data was wiped.
+// The server deletes the app password afterwards, so this must be the last request made with it.
+func (i *Instance) ConfirmRemoteWipe(ctx context.Context) error {
+	req, err := i.newWipeRequest(ctx, "success")
+	if err != nil {
+		return err
+	}
+
+	resp, err := i.do(req)
+	if err != nil {
+		return newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return newResponseError(resp)
+	}
+	return nil
+}
@@ -2,14 +2,14 @@ package nc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"io"
 	"net/http"
 )
 
-func (i *Instance) NewRequest(method string, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
+func (i *Instance) NewRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return req, err
 	}
@@ -20,8 +20,8 @@ func (i *Instance) NewRequest(method string, url string, body io.Reader) (*http.
 	return req, err
 }
 
-func (i *Instance) NewOCSRequest(method string, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
+func (i *Instance) NewOCSRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return req, err
 	}
@@ -30,50 +30,72 @@ func (i *Instance) NewOCSRequest(method string, url string, body io.Reader) (*ht
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("OCS-APIRequest", "true")
 	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(i.credentials.LoginName, i.credentials.AppPassword)
 
-	return req, err
+	if err = i.refreshAccessToken(ctx); err != nil {
+		return nil, err
+	}
+	setAuthorization(req, i.credentials)
+
+	return req, nil
 }
 
-func (i *Instance) ValidateCredentials(credentials AuthCredentials) (CredentialValidationResult, APIResponse, error) {
+// Sends OAuth2 credentials as a bearer token, and app passwords through basic auth.
+func setAuthorization(req *http.Request, credentials AuthCredentials) {
+	if credentials.IsOAuth2() {
+		req.Header.Set("Authorization", "Bearer "+credentials.AccessToken)
+	} else {
+		req.SetBasicAuth(credentials.LoginName, credentials.AppPassword)
+	}
+}
+
+func (i *Instance) ValidateCredentials(ctx context.Context, credentials AuthCredentials) (CredentialValidationResult, error) {
 	if credentials.LoginName == "" {
-		return CredentialsInvalid, APISuccess, nil
+		return CredentialsInvalid, nil
+	}
+
+	if credentials.IsOAuth2() && credentials.RefreshToken == i.credentials.RefreshToken {
+		// Our own OAuth2 credentials: the access token may have expired while we weren't running.
+		if err := i.refreshAccessToken(ctx); err != nil {
+			if ErrorKindOf(err) == ErrorLoginExpired {
+				return CredentialsExpired, nil
+			}
+			return CredentialsValidationFailed, err
+		}
+		credentials = i.credentials
 	}
 
 	// /ocs/v1.php/cloud/capabilities
-	req, err := i.NewOCSRequest(http.MethodGet, i.baseUrl+"/ocs/v2.php/apps/user_status/api/v1/user_status", bytes.NewReader([]byte("")))
+	req, err := i.NewOCSRequest(ctx, http.MethodGet, i.baseUrl+"/ocs/v2.php/apps/user_status/api/v1/user_status", bytes.NewReader([]byte("")))
 	if err != nil {
-		return CredentialsValidationFailed, APIUnreachable, err
+		return CredentialsValidationFailed, err
 	}
-	req.SetBasicAuth(credentials.LoginName, credentials.AppPassword)
+	setAuthorization(req, credentials)
 
-	resp, err := i.client.Do(req)
+	resp, err := i.do(req)
 	if err != nil {
-		return CredentialsValidationFailed, APIUnreachable, err
+		return CredentialsValidationFailed, newRequestError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 401 {
-		return CredentialsExpired, APISuccess, nil
-	} else if resp.StatusCode == 503 {
-		return CredentialsValidationFailed, APIMaintenance, nil
+		return CredentialsExpired, nil
 	} else if resp.StatusCode != 200 {
-		return CredentialsValidationFailed, APIUnreachable, errors.New("unknown server response")
+		return CredentialsValidationFailed, newResponseError(resp)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return CredentialsValidationFailed, APIUnreachable, err
+		return CredentialsValidationFailed, newRequestError(err)
 	}
 
 	ncRes := NextcloudOCSBaseResult[interface{}]{}
 	if err = json.Unmarshal(body, &ncRes); err != nil {
-		return CredentialsValidationFailed, APIUnreachable, err
+		return CredentialsValidationFailed, newDecodeError(resp, err)
 	}
 
 	if ncRes.OCS.Meta.Status == "ok" {
-		return CredentialsValid, APISuccess, nil
+		return CredentialsValid, nil
 	} else {
-		return CredentialsExpired, APISuccess, nil
+		return CredentialsExpired, nil
 	}
 }
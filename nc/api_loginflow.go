@@ -2,154 +2,299 @@ package nc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	ErrLoginFlowCancelled  = errors.New("the login flow was cancelled")
+	ErrLoginFlowExpired    = errors.New("the login flow expired")
+	ErrLoginFlowNotStarted = errors.New("the login flow wasn't started")
+)
+
+const (
+	DefaultLoginFlowTimeout      = time.Minute * 20
+	DefaultLoginFlowPollInterval = time.Second * 5
+)
+
+// Reported to the progress callback whenever the login flow is polled, and once when it ends.
+type LoginFlowProgress struct {
+	State     LoginFlowState
+	LoginURL  string        // Page the user must open to log in
+	Remaining time.Duration // Time left before the flow expires
+}
+
+// Implements Nextcloud Login Flow v2.
+// A flow is pending from Start until it succeeds, expires, gets cancelled or fails.
+// Each of those end states is final.
 type LoginFlow struct {
-	instance         *Instance
-	chanWaitFinished chan interface{}
-	chanCancel       chan interface{}
-	endpoint         string
-	token            string
-	requestStart     time.Time
-	updateTime       time.Duration
-
-	response    APIResponse
-	result      LoginResult
+	instance     *Instance
+	timeout      time.Duration
+	pollInterval time.Duration
+	onProgress   func(LoginFlowProgress)
+
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	finished chan struct{}
+	endpoint string
+	token    string
+	loginURL string
+	deadline time.Time
+
+	mutex       sync.Mutex
+	state       LoginFlowState
 	credentials *AuthCredentials
+	server      string
 	err         error
 }
 
-func (f *LoginFlow) Wait() (APIResponse, LoginResult, *AuthCredentials, error) {
-	<-f.chanWaitFinished
-	return f.response, f.result, f.credentials, f.err
+// How long the user has to log in. Must be set before Start.
+func (f *LoginFlow) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		f.timeout = timeout
+	}
+}
+
+// How often the server is asked whether the user logged in. Must be set before Start.
+func (f *LoginFlow) SetPollInterval(interval time.Duration) {
+	if interval > 0 {
+		f.pollInterval = interval
+	}
+}
+
+// Sets a callback notified of the flow progress. Must be set before Start.
+// The callback runs on the flow goroutine, and must not block.
+func (f *LoginFlow) OnProgress(callback func(LoginFlowProgress)) {
+	f.onProgress = callback
+}
+
+func (f *LoginFlow) State() LoginFlowState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.state
+}
+
+// Blocks until the flow ends, and returns its final state.
+// Credentials are only returned by a successful flow.
+// A flow that wasn't started, or failed to, fails with ErrLoginFlowNotStarted.
+func (f *LoginFlow) Wait() (LoginFlowState, *AuthCredentials, error) {
+	f.mutex.Lock()
+	finished := f.finished
+	f.mutex.Unlock()
+	if finished == nil {
+		return LoginFlowFailed, nil, ErrLoginFlowNotStarted
+	}
+	<-finished
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.state, f.credentials, f.err
 }
 
+// The server URL the credentials belong to, as advertised by the server.
+// Only known after a successful flow. It may differ from the base URL, but it's always a trusted host.
+func (f *LoginFlow) ServerURL() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.server
+}
+
+// Cancels a pending flow. Safe to call more than once, or after the flow ended.
 func (f *LoginFlow) Cancel() {
-	close(f.chanCancel)
+	if f.cancel != nil {
+		f.cancel(ErrLoginFlowCancelled)
+	}
 }
 
-func (f *LoginFlow) Start() (APIResponse, string, error) {
-	req, err := f.instance.NewRequest(http.MethodPost, f.instance.baseUrl+"/index.php/login/v2", bytes.NewReader([]byte("")))
+// Starts the flow and returns the URL of the login page.
+// The flow goes on in the background until it ends, or until ctx is done.
+func (f *LoginFlow) Start(ctx context.Context) (string, error) {
+	req, err := f.instance.NewRequest(ctx, http.MethodPost, f.instance.baseUrl+"/index.php/login/v2", bytes.NewReader([]byte("")))
 	if err != nil {
-		return APIUnreachable, "", err
+		return "", err
 	}
 
-	resp, err := f.instance.client.Do(req)
+	resp, err := f.instance.do(req)
 	if err != nil {
-		return APIUnreachable, "", err
+		return "", newRequestError(err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 503 {
-		return APIMaintenance, "", nil
+	if resp.StatusCode != 200 {
+		return "", newResponseError(resp)
 	}
 
-	f.requestStart = time.Now()
-
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return APIUnreachable, "", err
+		return "", newRequestError(err)
 	}
 
 	ncFlow := nextcloudLoginFlow{}
 	if err = json.Unmarshal(body, &ncFlow); err != nil {
-		return APIUnreachable, "", err
+		return "", newDecodeError(resp, err)
+	}
+	if ncFlow.Login == "" || ncFlow.Poll.Endpoint == "" || ncFlow.Poll.Token == "" {
+		return "", newDecodeError(resp, errors.New("incomplete login flow"))
 	}
 
-	f.endpoint = ncFlow.Poll.Endpoint
+	// The user types their password in the login page, and the poll endpoint returns the app password:
+	// neither of them may lead somewhere else.
+	loginURL, err := f.instance.CheckTrustedURL(ncFlow.Login)
+	if err != nil {
+		return "", err
+	}
+	endpoint, err := f.instance.CheckTrustedURL(ncFlow.Poll.Endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	f.ctx, f.cancel = context.WithCancelCause(ctx)
+	f.endpoint = endpoint
 	f.token = ncFlow.Poll.Token
+	f.loginURL = loginURL
+	f.deadline = time.Now().Add(f.timeout)
 
-	f.chanWaitFinished = make(chan interface{})
-	f.chanCancel = make(chan interface{})
-	f.response = APIUnreachable
-	f.result = LoginFailed
-	f.credentials = nil
-	f.err = nil
+	f.mutex.Lock()
+	f.finished = make(chan struct{})
+	f.state = LoginFlowPending
+	f.mutex.Unlock()
 
-	go f.runCheck()
+	go f.run()
 
-	return APISuccess, ncFlow.Login, nil
+	return loginURL, nil
 }
 
-func (f *LoginFlow) runCheck() {
-	defer close(f.chanWaitFinished)
+func (f *LoginFlow) reportProgress(state LoginFlowState) {
+	if f.onProgress == nil {
+		return
+	}
+	f.onProgress(LoginFlowProgress{
+		State:     state,
+		LoginURL:  f.loginURL,
+		Remaining: max(time.Until(f.deadline), 0),
+	})
+}
 
-	timer := time.NewTicker(f.updateTime)
-	defer timer.Stop()
+// Moves the flow to its final state.
+func (f *LoginFlow) finish(state LoginFlowState, credentials *AuthCredentials, err error) {
+	f.mutex.Lock()
+	f.state = state
+	f.credentials = credentials
+	f.err = err
+	f.mutex.Unlock()
+
+	f.cancel(nil)
+	f.reportProgress(state)
+	close(f.finished)
+}
+
+func (f *LoginFlow) run() {
+	f.reportProgress(LoginFlowPending)
+
+	ticker := time.NewTicker(f.pollInterval)
+	defer ticker.Stop()
+
+	expired := time.NewTimer(time.Until(f.deadline))
+	defer expired.Stop()
 
 	for {
 		select {
-		case <-timer.C:
-			if !f.runSingleCheck() {
-				close(f.chanCancel)
+		case <-ticker.C:
+			state, credentials, err := f.poll()
+			if state != LoginFlowPending {
+				f.finish(state, credentials, err)
 				return
 			}
-		case <-f.chanCancel:
+			f.reportProgress(LoginFlowPending)
+		case <-expired.C:
+			f.finish(LoginFlowExpired, nil, ErrLoginFlowExpired)
+			return
+		case <-f.ctx.Done():
+			f.finish(LoginFlowCancelled, nil, context.Cause(f.ctx))
 			return
 		}
 	}
 }
 
-// Keep this inside a dedicated function to let defers run freely.
-func (f *LoginFlow) runSingleCheck() bool {
-	if time.Since(f.requestStart).Minutes() >= 20 {
-		f.response = APISuccess
-		f.result = LoginFailed
-		return false
-	}
+// Asks the server whether the user logged in.
+// Transient errors keep the flow pending: the next poll tries again.
+func (f *LoginFlow) poll() (LoginFlowState, *AuthCredentials, error) {
+	form := url.Values{}
+	form.Set("token", f.token)
 
-	req, err := f.instance.NewRequest(http.MethodPost, f.endpoint, bytes.NewReader([]byte("token="+f.token)))
+	req, err := f.instance.NewRequest(f.ctx, http.MethodPost, f.endpoint, bytes.NewReader([]byte(form.Encode())))
 	if err != nil {
-		f.response = APIUnreachable
-		f.result = LoginError
-		f.err = err
-		return false
+		return LoginFlowFailed, nil, err
 	}
 
-	resp, err := f.instance.client.Do(req)
+	resp, err := f.instance.do(req)
 	if err != nil {
-		f.response = APIUnreachable
-		f.result = LoginError
-		f.err = err
-		return false
+		if f.ctx.Err() != nil {
+			return LoginFlowCancelled, nil, context.Cause(f.ctx)
+		}
+		if apiErr := newRequestError(err); !apiErr.Retryable() {
+			return LoginFlowFailed, nil, apiErr
+		}
+		return LoginFlowPending, nil, nil
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
-		return true
-	} else if resp.StatusCode == 503 {
-		f.response = APIMaintenance
-		f.result = LoginFailed
-		return false
+		// The user didn't log in yet.
+		return LoginFlowPending, nil, nil
+	} else if resp.StatusCode != 200 {
+		if apiErr := newResponseError(resp); !apiErr.Retryable() {
+			return LoginFlowFailed, nil, apiErr
+		}
+		return LoginFlowPending, nil, nil
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		f.response = APIUnreachable
-		f.result = LoginError
-		f.err = err
+		return LoginFlowFailed, nil, newRequestError(err)
 	}
 
 	ncRes := nextcloudAuthResult{}
 	if err = json.Unmarshal(body, &ncRes); err != nil {
-		f.response = APIUnreachable
-		f.result = LoginError
-		f.err = err
+		return LoginFlowFailed, nil, newDecodeError(resp, err)
+	}
+	if ncRes.LoginName == "" || ncRes.AppPassword == "" {
+		return LoginFlowFailed, nil, newDecodeError(resp, errors.New("the login flow returned no credentials"))
 	}
 
-	f.endpoint = ""
-	f.token = ""
-
-	f.response = APISuccess
-	f.result = LoginSuccessful
-	f.credentials = &AuthCredentials{
+	credentials := &AuthCredentials{
 		LoginName:   ncRes.LoginName,
 		AppPassword: ncRes.AppPassword,
 	}
-	f.err = nil
-	return false
+
+	server := f.instance.baseUrl
+	if ncRes.Server != "" {
+		if server, err = f.instance.CheckTrustedURL(ncRes.Server); err != nil {
+			// The server already issued the app password: don't leave it valid behind a failed login.
+			if revokeErr := f.revoke(*credentials); revokeErr != nil {
+				err = errors.Join(err, revokeErr)
+			}
+			return LoginFlowFailed, nil, err
+		}
+	}
+	f.mutex.Lock()
+	f.server = strings.TrimRight(server, "/")
+	f.mutex.Unlock()
+
+	return LoginFlowSucceeded, credentials, nil
+}
+
+// Revokes an app password the flow won't hand out, on the trusted base URL.
+func (f *LoginFlow) revoke(credentials AuthCredentials) error {
+	issuer := *f.instance
+	issuer.credentials = credentials
+	issuer.credentialUpdateProc = nil
+	return issuer.RevokeAppPassword(f.ctx)
 }
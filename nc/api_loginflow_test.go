@@ -0,0 +1,312 @@
+package nc
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testPollToken   = "poll-token"
+	testLoginName   = "alice"
+	testAppPassword = "app-password"
+)
+
+// A minimal Login Flow v2 server.
+// The poll endpoint answers 404 until pendingPolls polls went by, then returns pollBody.
+// An empty pollBody returns valid credentials for the server itself.
+type loginFlowServer struct {
+	*httptest.Server
+	pendingPolls int64
+	pollBody     string
+	polls        atomic.Int64
+	revoked      atomic.Value // App password deleted on the server, as a string
+
+	// The URLs advertised by the server. They default to the server itself.
+	loginURL string
+	pollURL  string
+}
+
+func newLoginFlowServer(t *testing.T, pendingPolls int64, pollBody string) *loginFlowServer {
+	s := &loginFlowServer{pendingPolls: pendingPolls, pollBody: pollBody}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /index.php/login/v2", func(w http.ResponseWriter, r *http.Request) {
+		flow := nextcloudLoginFlow{Login: cmp.Or(s.loginURL, s.URL+"/login/v2/flow/abc")}
+		flow.Poll.Token = testPollToken
+		flow.Poll.Endpoint = cmp.Or(s.pollURL, s.URL+"/login/v2/poll")
+		json.NewEncoder(w).Encode(flow)
+	})
+	mux.HandleFunc("POST /login/v2/poll", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != testPollToken {
+			http.Error(w, "bad token", http.StatusBadRequest)
+			return
+		}
+		if s.polls.Add(1) <= s.pendingPolls {
+			http.NotFound(w, r)
+			return
+		}
+		if s.pollBody == "" {
+			w.Write([]byte(pollBodyFor(s.URL)))
+			return
+		}
+		w.Write([]byte(s.pollBody))
+	})
+
+	mux.HandleFunc("DELETE /ocs/v2.php/core/apppassword", func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ := r.BasicAuth()
+		s.revoked.Store(password)
+		w.Write([]byte(`{"ocs":{"meta":{"status":"ok","statuscode":200},"data":[]}}`))
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func pollBodyFor(server string) string {
+	body, _ := json.Marshal(nextcloudAuthResult{
+		Server:      server,
+		LoginName:   testLoginName,
+		AppPassword: testAppPassword,
+	})
+	return string(body)
+}
+
+func newTestLoginFlow(server *loginFlowServer) *LoginFlow {
+	flow := NewInstance("test", server.URL).NewLoginFlow()
+	flow.SetPollInterval(time.Millisecond * 10)
+	return flow
+}
+
+func TestLoginFlowSucceeds(t *testing.T) {
+	server := newLoginFlowServer(t, 2, "")
+	flow := newTestLoginFlow(server)
+
+	var mutex sync.Mutex
+	var progress []LoginFlowState
+	flow.OnProgress(func(p LoginFlowProgress) {
+		mutex.Lock()
+		progress = append(progress, p.State)
+		mutex.Unlock()
+	})
+
+	loginURL, err := flow.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loginURL != server.URL+"/login/v2/flow/abc" {
+		t.Errorf("unexpected login URL %q", loginURL)
+	}
+
+	state, credentials, err := flow.Wait()
+	if state != LoginFlowSucceeded || err != nil {
+		t.Fatalf("expected success, got %v (%v)", state, err)
+	}
+	if credentials == nil || credentials.LoginName != testLoginName || credentials.AppPassword != testAppPassword {
+		t.Fatalf("unexpected credentials %+v", credentials)
+	}
+	if flow.ServerURL() != server.URL {
+		t.Errorf("unexpected server URL %q", flow.ServerURL())
+	}
+	if polls := server.polls.Load(); polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(progress) < 2 || progress[0] != LoginFlowPending || progress[len(progress)-1] != LoginFlowSucceeded {
+		t.Errorf("unexpected progress %v", progress)
+	}
+}
+
+func TestLoginFlowExpires(t *testing.T) {
+	server := newLoginFlowServer(t, 1<<30, "")
+	flow := newTestLoginFlow(server)
+	flow.SetTimeout(time.Millisecond * 50)
+
+	if _, err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	state, credentials, err := flow.Wait()
+	if state != LoginFlowExpired || credentials != nil || !errors.Is(err, ErrLoginFlowExpired) {
+		t.Fatalf("expected expiration, got %v %+v (%v)", state, credentials, err)
+	}
+}
+
+func TestLoginFlowCancel(t *testing.T) {
+	server := newLoginFlowServer(t, 1<<30, "")
+	flow := newTestLoginFlow(server)
+
+	if _, err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelling twice, or after the end, must not panic.
+	flow.Cancel()
+	flow.Cancel()
+
+	state, _, err := flow.Wait()
+	if state != LoginFlowCancelled || !errors.Is(err, ErrLoginFlowCancelled) {
+		t.Fatalf("expected cancellation, got %v (%v)", state, err)
+	}
+	flow.Cancel()
+
+	if flow.State() != LoginFlowCancelled {
+		t.Errorf("the final state changed to %v", flow.State())
+	}
+}
+
+func TestLoginFlowContextDone(t *testing.T) {
+	server := newLoginFlowServer(t, 1<<30, "")
+	flow := newTestLoginFlow(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := flow.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	state, _, err := flow.Wait()
+	if state != LoginFlowCancelled || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v (%v)", state, err)
+	}
+}
+
+func TestLoginFlowInvalidAnswers(t *testing.T) {
+	for name, body := range map[string]string{
+		"invalid JSON":      "{not json",
+		"empty credentials": `{"server":"https://cloud.example.org","loginName":"","appPassword":""}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := newLoginFlowServer(t, 0, body)
+			flow := newTestLoginFlow(server)
+
+			if _, err := flow.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			state, credentials, err := flow.Wait()
+			if state != LoginFlowFailed || credentials != nil || err == nil {
+				t.Fatalf("expected failure, got %v %+v (%v)", state, credentials, err)
+			}
+		})
+	}
+}
+
+func TestLoginFlowStartFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	flow := NewInstance("test", server.URL).NewLoginFlow()
+	_, err := flow.Start(context.Background())
+	if ErrorKindOf(err) != ErrorMaintenance {
+		t.Fatalf("expected a maintenance error, got %v", err)
+	}
+
+	// Waiting on a flow that didn't start returns right away.
+	if state, _, err := flow.Wait(); state != LoginFlowFailed || !errors.Is(err, ErrLoginFlowNotStarted) {
+		t.Errorf("expected a flow that wasn't started, got %v (%v)", state, err)
+	}
+}
+
+func TestLoginFlowWaitWithoutStart(t *testing.T) {
+	flow := NewInstance("test", "https://cloud.example.org").NewLoginFlow()
+	if state, _, err := flow.Wait(); state != LoginFlowFailed || !errors.Is(err, ErrLoginFlowNotStarted) {
+		t.Errorf("expected a flow that wasn't started, got %v (%v)", state, err)
+	}
+}
+
+func TestLoginFlowRejectsUntrustedURLs(t *testing.T) {
+	for name, setup := range map[string]func(s *loginFlowServer){
+		"login URL": func(s *loginFlowServer) { s.loginURL = "https://phishing.example.org/login" },
+		"poll URL":  func(s *loginFlowServer) { s.pollURL = "https://phishing.example.org/poll" },
+		"userinfo":  func(s *loginFlowServer) { s.loginURL = "http://user:pass@" + s.Listener.Addr().String() + "/login" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := newLoginFlowServer(t, 0, "")
+			setup(server)
+
+			_, err := newTestLoginFlow(server).Start(context.Background())
+			var untrusted *UntrustedURLError
+			if !errors.As(err, &untrusted) {
+				t.Fatalf("expected an untrusted URL error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoginFlowRejectsUntrustedServer(t *testing.T) {
+	server := newLoginFlowServer(t, 0, pollBodyFor("https://phishing.example.org"))
+	flow := newTestLoginFlow(server)
+
+	if _, err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	state, credentials, err := flow.Wait()
+	var untrusted *UntrustedURLError
+	if state != LoginFlowFailed || credentials != nil || !errors.As(err, &untrusted) {
+		t.Fatalf("expected an untrusted server, got %v %+v (%v)", state, credentials, err)
+	}
+	// The app password issued anyway doesn't stay valid.
+	if revoked, _ := server.revoked.Load().(string); revoked != testAppPassword {
+		t.Errorf("got revoked app password %q, want %q", revoked, testAppPassword)
+	}
+}
+
+func TestLoginFlowAcceptsAliases(t *testing.T) {
+	server := newLoginFlowServer(t, 0, pollBodyFor("https://cloud.example.org/"))
+	flow := newTestLoginFlow(server)
+	flow.instance.SetTrustedAliases([]string{"cloud.example.org"})
+
+	if _, err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _, err := flow.Wait()
+	if state != LoginFlowSucceeded {
+		t.Fatalf("expected success, got %v (%v)", state, err)
+	}
+	if flow.ServerURL() != "https://cloud.example.org" {
+		t.Errorf("unexpected server URL %q", flow.ServerURL())
+	}
+}
+
+func TestCheckTrustedURLUpgradesToHTTPS(t *testing.T) {
+	instance := NewInstance("test", "https://cloud.example.org/")
+	instance.SetTrustedAliases([]string{"https://old.example.org", "files.example.org:8443"})
+
+	for raw, expected := range map[string]string{
+		"https://cloud.example.org/index.php/login/v2/flow": "https://cloud.example.org/index.php/login/v2/flow",
+		"http://cloud.example.org/index.php/login/v2/poll":  "https://cloud.example.org/index.php/login/v2/poll",
+		"https://old.example.org/":                          "https://old.example.org/",
+		"https://files.example.org:8443/":                   "https://files.example.org:8443/",
+	} {
+		got, err := instance.CheckTrustedURL(raw)
+		if err != nil || got != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", raw, expected, got, err)
+		}
+	}
+
+	for _, raw := range []string{
+		"https://files.example.org/",
+		"https://cloud.example.org.evil.com/",
+		"ftp://cloud.example.org/",
+		"/relative",
+	} {
+		if _, err := instance.CheckTrustedURL(raw); err == nil {
+			t.Errorf("%s: expected an error", raw)
+		}
+	}
+}
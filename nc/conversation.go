@@ -0,0 +1,157 @@
+package nc
+
+type ConversationKind int64
+type SenderKind int64
+
+const (
+	ConversationGroup ConversationKind = iota
+	ConversationOneToOne
+	ConversationChangelog
+	ConversationNoteToSelf
+	ConversationFileChat
+	ConversationVideoVerification
+	ConversationPhone
+)
+
+func (k ConversationKind) String() string {
+	switch k {
+	case ConversationOneToOne:
+		return "one-to-one"
+	case ConversationChangelog:
+		return "changelog"
+	case ConversationNoteToSelf:
+		return "note to self"
+	case ConversationFileChat:
+		return "file chat"
+	case ConversationVideoVerification:
+		return "video verification"
+	case ConversationPhone:
+		return "phone"
+	}
+	return "group"
+}
+
+const (
+	SenderUser SenderKind = iota
+	SenderGuest
+	SenderBot
+	SenderBridged
+	SenderSystem
+)
+
+// Talk room types, as returned by the room API.
+const (
+	roomTypeOneToOne       = 1
+	roomTypeGroup          = 2
+	roomTypePublic         = 3
+	roomTypeChangelog      = 4
+	roomTypeFormerOneToOne = 5
+	roomTypeNoteToSelf     = 6
+)
+
+// Talk room object types, set when a room is bound to another Nextcloud object.
+const (
+	roomObjectFile          = "file"
+	roomObjectSharePassword = "share:password"
+	roomObjectPhone         = "phone"
+	roomObjectEvent         = "event"
+)
+
+// Classifies a conversation by its room type first, then by the object it is bound to.
+func ClassifyConversation(conv *NextcloudSpreedConversationData) ConversationKind {
+	switch conv.Type {
+	case roomTypeChangelog:
+		return ConversationChangelog
+	case roomTypeNoteToSelf:
+		return ConversationNoteToSelf
+	}
+
+	switch conv.ObjectType {
+	case roomObjectFile:
+		return ConversationFileChat
+	case roomObjectSharePassword:
+		return ConversationVideoVerification
+	case roomObjectPhone:
+		return ConversationPhone
+	case roomObjectEvent:
+		return ConversationGroup
+	}
+
+	switch conv.Type {
+	case roomTypeOneToOne, roomTypeFormerOneToOne:
+		return ConversationOneToOne
+	}
+
+	return ConversationGroup
+}
+
+// Classifies the sender of a message by its actor type.
+func ClassifySender(msg *NextcloudSpreedMessageData) SenderKind {
+	if msg.SystemMessage != "" {
+		return SenderSystem
+	}
+
+	switch msg.ActorType {
+	case "guests", "emails":
+		return SenderGuest
+	case "bots":
+		return SenderBot
+	case "bridged":
+		return SenderBridged
+	}
+
+	return SenderUser
+}
+
+// Whether the message was written by the user the conversation was fetched for.
+func isOwnMessage(conv *NextcloudSpreedConversationData, msg *NextcloudSpreedMessageData) bool {
+	return msg.ActorType == conv.ActorType && msg.ActorId == conv.ActorId
+}
+
+// Whether a conversation with unread messages should produce a notification.
+func (s *NotificationSettings) allows(conv *NextcloudSpreedConversationData) bool {
+	if conv.NotificationLevel == 3 && !s.ShowMutedNotifications {
+		return false
+	}
+
+	kind := ClassifyConversation(conv)
+	switch kind {
+	case ConversationOneToOne:
+		if !s.ShowUserNotifications {
+			return false
+		}
+	case ConversationGroup:
+		if !s.ShowGroupNotifications {
+			return false
+		}
+	case ConversationChangelog:
+		// Changelog messages are posted by a synthetic guest: sender filters don't apply.
+		return s.ShowChangelogNotifications
+	case ConversationNoteToSelf:
+		// Every message is written by the user: sender filters don't apply.
+		return s.ShowNoteToSelfNotifications
+	case ConversationFileChat:
+		if !s.ShowFileChatNotifications {
+			return false
+		}
+	case ConversationVideoVerification:
+		if !s.ShowVideoVerificationNotifications {
+			return false
+		}
+	case ConversationPhone:
+		if !s.ShowPhoneNotifications {
+			return false
+		}
+	}
+
+	switch ClassifySender(&conv.LastMessage) {
+	case SenderBot:
+		return s.ShowBotNotifications
+	case SenderGuest:
+		return s.ShowGuestNotifications
+	case SenderBridged:
+		return s.ShowBridgedNotifications
+	}
+
+	return true
+}
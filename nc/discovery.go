@@ -0,0 +1,158 @@
+package nc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Returned when no Nextcloud server answers at the address given by the user.
+var ErrNotNextcloud = errors.New("no Nextcloud server found at this address")
+
+// Reply of status.php, which every Nextcloud server serves next to index.php
+type nextcloudStatus struct {
+	Installed   bool   `json:"installed"`
+	Maintenance bool   `json:"maintenance"`
+	Version     string `json:"versionstring"`
+	ProductName string `json:"productname"`
+}
+
+// Paths of the web interface, found in addresses copied out of the browser.
+// The base URL is whatever comes before them.
+var webInterfacePaths = []string{"/index.php", "/apps/", "/login", "/ocs/", "/remote.php", "/status.php", "/call/", "/s/", "/f/"}
+
+// Reads an address typed by the user. The scheme defaults to HTTPS.
+func parseServerAddress(address string) (*url.URL, error) {
+	address = strings.TrimSpace(address)
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.New("unsupported scheme " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host name")
+	}
+	if u.User != nil {
+		return nil, errors.New("the address can't contain credentials")
+	}
+	return u, nil
+}
+
+// Lists the base URLs worth probing for an address: the address without any web interface path, then its origin.
+func discoveryCandidates(u *url.URL) []string {
+	path := u.Path
+	for _, p := range webInterfacePaths {
+		if idx := strings.Index(path, p); idx >= 0 {
+			path = path[:idx]
+		}
+	}
+
+	origin := u.Scheme + "://" + u.Host
+	candidates := []string{origin + strings.TrimRight(path, "/")}
+	if candidates[0] != origin {
+		candidates = append(candidates, origin)
+	}
+	return candidates
+}
+
+// Asks status.php whether a Nextcloud server lives at base, following redirects.
+// Returns the base URL the server answered from.
+func (i *Instance) probeStatus(ctx context.Context, base string) (string, error) {
+	req, err := i.NewRequest(ctx, http.MethodGet, base+"/status.php", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := i.do(req)
+	if err != nil {
+		return "", newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newResponseError(resp)
+	}
+
+	status := nextcloudStatus{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&status); err != nil || !status.Installed {
+		return "", ErrNotNextcloud
+	}
+
+	// After redirects, the final request tells where the server really is.
+	final := *resp.Request.URL
+	final.RawQuery = ""
+	final.Fragment = ""
+	return strings.TrimSuffix(final.String(), "/status.php"), nil
+}
+
+// Servers installed in a subfolder redirect /.well-known/carddav to their DAV endpoint.
+// Returns the base URL found in that redirect.
+func (i *Instance) probeWellKnown(ctx context.Context, origin string) (string, error) {
+	req, err := i.NewRequest(ctx, http.MethodGet, origin+"/.well-known/carddav", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := i.do(req)
+	if err != nil {
+		return "", newRequestError(err)
+	}
+	resp.Body.Close()
+
+	// The DAV endpoint itself usually answers 401 or 405: only the redirect matters.
+	base, _, found := strings.Cut(resp.Request.URL.Path, "/remote.php/")
+	if !found {
+		return "", ErrNotNextcloud
+	}
+	return i.probeStatus(ctx, resp.Request.URL.Scheme+"://"+resp.Request.URL.Host+base)
+}
+
+// Whether the request never got an answer, so that asking the same host again is pointless.
+func isUnreachable(err error) bool {
+	apiErr, ok := AsAPIError(err)
+	return ok && (apiErr.Kind == ErrorNetwork || apiErr.Kind == ErrorCertificate || apiErr.Kind == ErrorCanceled)
+}
+
+// Finds the base URL of the Nextcloud server at an address typed by the user or copied from the browser.
+// Redirects are followed, web interface paths such as /index.php/apps/spreed are cut,
+// and /.well-known/carddav is asked last, for servers installed in a subfolder.
+// On success, the instance moves to the discovered base URL, which is returned.
+func (i *Instance) DiscoverBaseURL(ctx context.Context, address string) (string, error) {
+	u, err := parseServerAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := discoveryCandidates(u)
+	for _, candidate := range candidates {
+		base, err := i.probeStatus(ctx, candidate)
+		if err == nil {
+			i.SetBaseURL(base)
+			return i.baseUrl, nil
+		}
+		if isUnreachable(err) {
+			return "", err
+		}
+	}
+
+	base, err := i.probeWellKnown(ctx, candidates[len(candidates)-1])
+	if err != nil {
+		if isUnreachable(err) {
+			return "", err
+		}
+		return "", ErrNotNextcloud
+	}
+	i.SetBaseURL(base)
+	return i.baseUrl, nil
+}
@@ -0,0 +1,190 @@
+package nc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type APIErrorKind int64
+
+const (
+	ErrorNetwork            APIErrorKind = iota // The server could not be reached, or the connection dropped
+	ErrorCertificate                            // The server certificate was rejected
+	ErrorCanceled                               // The request was canceled before completing
+	ErrorLoginExpired                           // 401: the credentials are no longer valid
+	ErrorForbidden                              // 403: the user isn't allowed to use this API
+	ErrorNotFound                               // 404: the API doesn't exist, usually because the app is disabled
+	ErrorPreconditionFailed                     // 412: the request was refused, usually by a CSRF or OCS check
+	ErrorRateLimited                            // 429, or throttled by the brute-force protection
+	ErrorMaintenance                            // 503: the server is in maintenance mode
+	ErrorServer                                 // Any other 5xx
+	ErrorUnexpectedResponse                     // Any other status, or a body that couldn't be decoded
+)
+
+func (k APIErrorKind) String() string {
+	switch k {
+	case ErrorNetwork:
+		return "network error"
+	case ErrorCertificate:
+		return "certificate error"
+	case ErrorCanceled:
+		return "request canceled"
+	case ErrorLoginExpired:
+		return "login expired"
+	case ErrorForbidden:
+		return "access forbidden"
+	case ErrorNotFound:
+		return "not found"
+	case ErrorPreconditionFailed:
+		return "precondition failed"
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorMaintenance:
+		return "maintenance mode"
+	case ErrorServer:
+		return "server error"
+	}
+	return "unexpected response"
+}
+
+type APIError struct {
+	Kind       APIErrorKind
+	StatusCode int // HTTP status code, 0 if no response was received
+
+	OCSStatusCode int    // OCS meta.statuscode, if the body could be decoded
+	OCSMessage    string // OCS meta.message, if the body could be decoded
+
+	RetryAfter time.Duration // Delay requested by the server through Retry-After, 0 if none
+	Throttled  bool          // Whether the brute-force protection slowed this request down
+
+	Err error // Underlying error, if any
+}
+
+func (e *APIError) Error() string {
+	msg := e.Kind.String()
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.StatusCode)
+	}
+	if e.OCSMessage != "" {
+		msg += ": " + e.OCSMessage
+	} else if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Whether the same request is expected to succeed later, without any user intervention.
+func (e *APIError) Retryable() bool {
+	switch e.Kind {
+	case ErrorNetwork, ErrorRateLimited, ErrorMaintenance, ErrorServer:
+		return true
+	}
+	return false
+}
+
+// Returns the APIError wrapped in err, if any.
+func AsAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr, true
+	}
+	return nil, false
+}
+
+// Returns the kind of the APIError wrapped in err.
+// Errors that didn't come from the API are reported as network errors.
+func ErrorKindOf(err error) APIErrorKind {
+	if apiErr, ok := AsAPIError(err); ok {
+		return apiErr.Kind
+	}
+	return ErrorNetwork
+}
+
+// Wraps an error returned by the HTTP client, when no response was received.
+func newRequestError(err error) *APIError {
+	kind := ErrorNetwork
+	if IsCertificateError(err) {
+		kind = ErrorCertificate
+	} else if errors.Is(err, context.Canceled) {
+		kind = ErrorCanceled
+	}
+
+	return &APIError{Kind: kind, Err: err}
+}
+
+// Wraps a response body that could not be read or decoded.
+func newDecodeError(resp *http.Response, err error) *APIError {
+	return &APIError{Kind: ErrorUnexpectedResponse, StatusCode: resp.StatusCode, Err: err}
+}
+
+// Parses Retry-After, which holds either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// Builds an APIError out of an unsuccessful response.
+// The body is consumed, looking for an OCS envelope with a more detailed message.
+func newResponseError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Throttled:  resp.Header.Get("X-Nextcloud-Bruteforce-Throttled") != "",
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		apiErr.Kind = ErrorLoginExpired
+	case resp.StatusCode == http.StatusForbidden:
+		apiErr.Kind = ErrorForbidden
+	case resp.StatusCode == http.StatusNotFound:
+		apiErr.Kind = ErrorNotFound
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		apiErr.Kind = ErrorPreconditionFailed
+	case resp.StatusCode == http.StatusTooManyRequests:
+		apiErr.Kind = ErrorRateLimited
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		apiErr.Kind = ErrorMaintenance
+	case resp.StatusCode >= 500:
+		apiErr.Kind = ErrorServer
+	default:
+		apiErr.Kind = ErrorUnexpectedResponse
+	}
+
+	// A throttled request can still succeed, but the brute-force protection is watching:
+	// anything other than a success means we should slow down.
+	if apiErr.Throttled && apiErr.Kind != ErrorLoginExpired {
+		apiErr.Kind = ErrorRateLimited
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err == nil {
+		ocs := NextcloudOCSBaseResult[json.RawMessage]{}
+		if json.Unmarshal(body, &ocs) == nil {
+			apiErr.OCSStatusCode = ocs.OCS.Meta.StatusCode
+			apiErr.OCSMessage = ocs.OCS.Meta.Message
+		}
+	}
+
+	return apiErr
+}
@@ -3,33 +3,64 @@ package nc
 import (
 	"net/http"
 	"strings"
-	"time"
 )
 
 type Instance struct {
 	instanceName string
 	baseUrl      string
 	client       *http.Client
+	httpSettings HTTPSettings
 	userAgent    string
 	credentials  AuthCredentials
 
+	trustedAliases []string
+	oauth2Config   OAuth2Config
+
 	credentialUpdateProc func(AuthCredentials)
+	noTokenRefresh       bool // Another process owns the OAuth2 credentials
 }
 
 func NewInstance(instanceName string, url string) *Instance {
+	httpSettings := DefaultHTTPSettings()
+
+	// The default settings carry no TLS or proxy configuration, so this can't fail.
+	client, _ := newHTTPClient(httpSettings)
+
 	return &Instance{
 		instanceName:         instanceName,
 		baseUrl:              strings.TrimRight(url, "/"),
-		client:               http.DefaultClient,
+		client:               client,
+		httpSettings:         httpSettings,
 		userAgent:            "Nextcloud Talk Client (GoTalk)",
 		credentialUpdateProc: nil,
 	}
 }
 
+// Replaces the HTTP client with one honouring the given timeouts, retry policy, TLS and proxy settings.
+// Zero values fall back to the defaults.
+// On error, the previous client is kept.
+func (i *Instance) SetHTTPSettings(settings HTTPSettings) error {
+	settings = settings.WithDefaults()
+
+	client, err := newHTTPClient(settings)
+	if err != nil {
+		return err
+	}
+
+	i.httpSettings = settings
+	i.client = client
+	return nil
+}
+
 func (i *Instance) GetBaseURL() string {
 	return i.baseUrl
 }
 
+// Moves the instance to another URL, usually one of its trusted aliases.
+func (i *Instance) SetBaseURL(url string) {
+	i.baseUrl = strings.TrimRight(url, "/")
+}
+
 func (i *Instance) SetCredentials(credentials AuthCredentials) {
 	i.credentials = credentials
 	if i.credentialUpdateProc != nil {
@@ -37,6 +68,13 @@ func (i *Instance) SetCredentials(credentials AuthCredentials) {
 	}
 }
 
+// Stops refreshing OAuth2 access tokens, while another process owns the credentials:
+// Nextcloud issues a new refresh token with every refresh, which would leave the other process with a dead one.
+// Requests fail with ErrTokenRefreshDisabled once the access token expires.
+func (i *Instance) DisableTokenRefresh() {
+	i.noTokenRefresh = true
+}
+
 func (i *Instance) OnCredentialsUpdated(credUpdateProc func(AuthCredentials)) {
 	i.credentialUpdateProc = credUpdateProc
 }
@@ -47,7 +85,8 @@ func (i *Instance) GetCredentials() AuthCredentials {
 
 func (i *Instance) NewLoginFlow() *LoginFlow {
 	return &LoginFlow{
-		instance:   i,
-		updateTime: time.Second * 5,
+		instance:     i,
+		timeout:      DefaultLoginFlowTimeout,
+		pollInterval: DefaultLoginFlowPollInterval,
 	}
 }
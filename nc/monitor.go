@@ -1,6 +1,22 @@
 package nc
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// How many unread messages are fetched when a conversation has more than one
+	maxUnreadTailLength = 5
+	// How many of those messages end up in the notification body
+	maxPreviewLines = 3
+	// How many conversations are listed in a digest notification
+	maxDigestLines = 8
+	// How many new messages are scanned for watchlist matches in a filtered conversation
+	maxWatchlistScan = 50
+)
 
 type NotificationSettings struct {
 	ShowUserNotifications    bool // Whether to show notifications for regular 1-on-1 chats
@@ -10,24 +26,62 @@ type NotificationSettings struct {
 	ShowBridgedNotifications bool // Whether to show notifications for bridged chats
 	ShowMutedNotifications   bool // Force notifications to be shown even if the conversation was muted
 	PlayNotificationSounds   bool // Plays a notification sound
+
+	ShowNoteToSelfNotifications        bool // Whether to show notifications for the note-to-self conversation
+	ShowChangelogNotifications         bool // Whether to show notifications for the Talk changelog conversation
+	ShowFileChatNotifications          bool // Whether to show notifications for chats bound to a file
+	ShowVideoVerificationNotifications bool // Whether to show notifications for password-protected share verification calls
+	ShowPhoneNotifications             bool // Whether to show notifications for phone (SIP dial-out) conversations
+}
+
+func DefaultNotificationSettings() NotificationSettings {
+	return NotificationSettings{
+		ShowUserNotifications:    true,
+		ShowGroupNotifications:   true,
+		ShowBotNotifications:     true,
+		ShowGuestNotifications:   true,
+		ShowBridgedNotifications: true,
+		ShowMutedNotifications:   false,
+		PlayNotificationSounds:   true,
+
+		ShowNoteToSelfNotifications:        false,
+		ShowChangelogNotifications:         false,
+		ShowFileChatNotifications:          true,
+		ShowVideoVerificationNotifications: true,
+		ShowPhoneNotifications:             true,
+	}
 }
 
-type NotificationSender func(instance string, title string, message string, url string, playAudio bool) error
 type NotificationCountSetter func(instance string, unfilteredCount uint, filteredCount uint) error
 type NotificationSettingsGetter func() NotificationSettings
 
 type conversationLocalStorage struct {
 	lastNotificationTimestamp time.Time
 	lastMessageId             int64
+	notificationHandle        NotificationHandle
+	lastScannedMessageId      int64
+}
+
+// What the last check saw happening on the server.
+type Activity struct {
+	LastActivity   time.Time // Most recent activity in any conversation
+	CallInProgress bool      // Whether a call is running in any conversation
 }
 
 type Monitor struct {
 	ncInstance              *Instance
 	repeatTime              float64
 	notificationSender      NotificationSender
+	notificationWithdrawer  NotificationWithdrawer
 	notificationCountSetter NotificationCountSetter
 	settingsGetter          NotificationSettingsGetter
 	conversationData        map[int64]conversationLocalStorage
+	digestThreshold         uint
+	digestHandle            NotificationHandle
+	watchlist               *Watchlist
+	activity                Activity
+	rooms                   roomCache
+	snoozed                 map[string]time.Time // Conversations whose notifications are held back, by token, until the given time
 }
 
 func NewMonitor(instance *Instance, repeatTime float64) *Monitor {
@@ -44,10 +98,74 @@ func (m *Monitor) SetNotificationSender(sender NotificationSender) {
 	m.notificationSender = sender
 }
 
+func (m *Monitor) SetNotificationWithdrawer(withdrawer NotificationWithdrawer) {
+	m.notificationWithdrawer = withdrawer
+}
+
 func (m *Monitor) SetNotificationCountSetter(setter NotificationCountSetter) {
 	m.notificationCountSetter = setter
 }
 
+// Above this many conversations with new messages in a single check,
+// a single digest notification is sent instead. 0 disables digests.
+func (m *Monitor) SetDigestThreshold(threshold uint) {
+	m.digestThreshold = threshold
+}
+
+// Messages in muted or filtered conversations still produce a notification when they match the watchlist.
+func (m *Monitor) SetWatchlist(watchlist *Watchlist) {
+	m.watchlist = watchlist
+}
+
+// Returns what the last successful check saw happening on the server.
+func (m *Monitor) Activity() Activity {
+	return m.activity
+}
+
+// Forgets every conversation and withdraws the notifications shown for them.
+// Used when the account is logged out or wiped.
+func (m *Monitor) Reset() {
+	for _, convLocal := range m.conversationData {
+		m.withdrawMessageNotification(convLocal.notificationHandle)
+	}
+	m.withdrawMessageNotification(m.digestHandle)
+
+	m.conversationData = make(map[int64]conversationLocalStorage)
+	m.digestHandle = ""
+	m.activity = Activity{}
+	m.rooms = roomCache{}
+	m.snoozed = nil
+}
+
+// Holds back the notifications of a conversation until the given time.
+// The notification already shown for it is withdrawn by the next check.
+func (m *Monitor) Snooze(token string, until time.Time) {
+	if m.snoozed == nil {
+		m.snoozed = make(map[string]time.Time)
+	}
+	m.snoozed[token] = until
+}
+
+// Marks a conversation as read on the server.
+// The cached room follows right away: the next check withdraws its notification,
+// whether or not the server lists the conversation again.
+func (m *Monitor) MarkConversationRead(ctx context.Context, token string) error {
+	if err := m.ncInstance.MarkConversationRead(ctx, token); err != nil {
+		return err
+	}
+	m.rooms.markRead(token)
+	return nil
+}
+
+func (m *Monitor) isSnoozed(token string) bool {
+	until, ok := m.snoozed[token]
+	if ok && time.Now().After(until) {
+		delete(m.snoozed, token)
+		return false
+	}
+	return ok
+}
+
 func (m *Monitor) SetNotificationSettingsGetter(getter NotificationSettingsGetter) {
 	m.settingsGetter = getter
 }
@@ -57,35 +175,106 @@ func (m *Monitor) getNotificationSettings() NotificationSettings {
 		return m.settingsGetter()
 	}
 
-	return NotificationSettings{
-		ShowUserNotifications:    true,
-		ShowGroupNotifications:   true,
-		ShowBotNotifications:     true,
-		ShowGuestNotifications:   true,
-		ShowBridgedNotifications: true,
-		ShowMutedNotifications:   false,
-		PlayNotificationSounds:   true,
-	}
+	return DefaultNotificationSettings()
 }
 
-func (m *Monitor) sendMessageNotification(title string, message string, url string, playAudio bool) error {
+func (m *Monitor) sendMessageNotification(notification Notification) (NotificationResult, error) {
 	if m.notificationSender != nil {
-		return m.notificationSender(m.ncInstance.instanceName, title, message, url, playAudio)
+		notification.Instance = m.ncInstance.instanceName
+		return m.notificationSender(notification)
+	}
+	return NotificationResult{}, nil
+}
+
+func (m *Monitor) withdrawMessageNotification(handle NotificationHandle) error {
+	if m.notificationWithdrawer != nil && handle != "" {
+		return m.notificationWithdrawer(m.ncInstance.instanceName, handle)
 	}
 	return nil
 }
 
-func (m *Monitor) ProcessMessages() (APIResponse, error) {
-	conversations, resp, err := m.ncInstance.GetUserConversations()
-	if resp != APISuccess || err != nil {
-		return resp, err
+func (m *Monitor) newMessageNotification(conv *NextcloudSpreedConversationData, playAudio bool) Notification {
+	urgency := UrgencyNormal
+	if conv.UnreadMentionDirect || ClassifyConversation(conv) == ConversationOneToOne {
+		urgency = UrgencyCritical
+	}
+
+	return Notification{
+		Title:             conv.DisplayName,
+		Message:           conv.LastMessage.format(),
+		URL:               m.ncInstance.GetBaseURL() + "/call/" + conv.Token,
+		PlayAudio:         playAudio,
+		ConversationToken: conv.Token,
+		MessageId:         conv.LastMessage.Id,
+		ActorType:         conv.LastMessage.ActorType,
+		ActorId:           conv.LastMessage.ActorId,
+		ActorDisplayName:  conv.LastMessage.ActorDisplayName,
+		AvatarURL:         m.ncInstance.GetBaseURL() + "/ocs/v2.php/apps/spreed/api/v1/room/" + conv.Token + "/avatar",
+		Mention:           conv.UnreadMention,
+		Urgency:           urgency,
+		Category:          CategoryMessage,
+	}
+}
+
+// Whether a notification is shown for any conversation, which then has to be withdrawn once read.
+func (m *Monitor) isNotifying() bool {
+	if m.digestHandle != "" {
+		return true
+	}
+	for _, convLocal := range m.conversationData {
+		if convLocal.notificationHandle != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Forgets the conversations missing from the whole list, which the user left or which were deleted,
+// and withdraws their notification: it could never be withdrawn once read.
+func (m *Monitor) forgetUnlisted(conversations []NextcloudSpreedConversationData) {
+	listed := make(map[int64]bool, len(conversations))
+	for _, conv := range conversations {
+		listed[conv.Id] = true
+	}
+	for id, convLocal := range m.conversationData {
+		if listed[id] {
+			continue
+		}
+		m.withdrawMessageNotification(convLocal.notificationHandle)
+		delete(m.conversationData, id)
+	}
+}
+
+func (m *Monitor) ProcessMessages(ctx context.Context) error {
+	// The incremental list stays cheap as long as nothing needs to be withdrawn.
+	conversations, full, err := m.rooms.refresh(ctx, m.ncInstance, m.isNotifying())
+	if err != nil {
+		return err
+	}
+	if full {
+		m.forgetUnlisted(conversations)
 	}
 
 	activeSettings := m.getNotificationSettings()
 
+	// Notifications are sent once every conversation has been processed.
+	// Each of them remembers the conversation it came from, so the returned handle can be stored.
+	type pendingNotification struct {
+		conv         *NextcloudSpreedConversationData
+		notification Notification
+	}
+	var pending []pendingNotification
+	var watchlistPending []pendingNotification
+
 	var filteredCount uint = 0
 	var unfilteredCount uint = 0
-	for _, conv := range *conversations {
+	activity := Activity{}
+	for _, conv := range conversations {
+		if lastActivity := time.Unix(conv.LastActivity, 0); lastActivity.After(activity.LastActivity) {
+			activity.LastActivity = lastActivity
+		}
+		activity.CallInProgress = activity.CallInProgress || conv.HasCall
+
 		var convLocal conversationLocalStorage
 		var ok bool
 		if convLocal, ok = m.conversationData[conv.Id]; !ok {
@@ -95,36 +284,221 @@ func (m *Monitor) ProcessMessages() (APIResponse, error) {
 			}
 		}
 
-		if conv.UnreadMessages > 0 && conv.LastMessage.ActorId != conv.ActorId {
+		if conv.UnreadMessages == 0 && convLocal.notificationHandle != "" {
+			// The conversation was read elsewhere: the notification is stale.
+			if err := m.withdrawMessageNotification(convLocal.notificationHandle); err == nil {
+				convLocal.notificationHandle = ""
+				m.conversationData[conv.Id] = convLocal
+			}
+		}
+
+		isNoteToSelf := ClassifyConversation(&conv) == ConversationNoteToSelf
+		if conv.UnreadMessages > 0 && (!isOwnMessage(&conv, &conv.LastMessage) || isNoteToSelf) {
 			unfilteredCount += 1
-			if conv.NotificationLevel == 3 && !activeSettings.ShowMutedNotifications {
-				continue
-			} else if (conv.ActorType == "bots" || conv.LastMessage.ActorType == "bots") && !activeSettings.ShowBotNotifications {
-				continue
-			} else if (conv.ActorType == "bridged" || conv.LastMessage.ActorType == "bridged") && !activeSettings.ShowBridgedNotifications {
-				continue
-			} else if (conv.ActorType == "guests" || conv.LastMessage.ActorType == "guests") && !activeSettings.ShowGuestNotifications {
-				continue
-			} else if (conv.Type == 1 || conv.Type == 5) && !activeSettings.ShowUserNotifications {
+			if m.isSnoozed(conv.Token) {
+				if convLocal.notificationHandle != "" {
+					if err := m.withdrawMessageNotification(convLocal.notificationHandle); err == nil {
+						convLocal.notificationHandle = ""
+					}
+				}
+				m.conversationData[conv.Id] = convLocal
 				continue
-			} else if (conv.Type == 2 || conv.Type == 3) && !activeSettings.ShowGroupNotifications {
+			}
+			if !activeSettings.allows(&conv) {
+				if notification, ok := m.scanWatchlist(ctx, &conv, &convLocal, activeSettings.PlayNotificationSounds); ok {
+					notification.Replaces = convLocal.notificationHandle
+					watchlistPending = append(watchlistPending, pendingNotification{&conv, notification})
+				}
+				m.conversationData[conv.Id] = convLocal
 				continue
 			}
 			filteredCount += 1
 
 			minsSinceLastNotification := time.Since(convLocal.lastNotificationTimestamp).Minutes()
 			if (minsSinceLastNotification >= 0.5 && minsSinceLastNotification >= m.repeatTime) || conv.LastMessage.Id != convLocal.lastMessageId {
-				textPreview := conv.LastMessage.format()
+				notification := m.newMessageNotification(&conv, activeSettings.PlayNotificationSounds)
+				notification.Replaces = convLocal.notificationHandle
 				convLocal.lastNotificationTimestamp = time.Now()
 				convLocal.lastMessageId = conv.LastMessage.Id
 				m.conversationData[conv.Id] = convLocal
-				defer m.sendMessageNotification(conv.DisplayName, textPreview, m.ncInstance.GetBaseURL()+"/call/"+conv.LastMessage.Token, activeSettings.PlayNotificationSounds)
+				pending = append(pending, pendingNotification{&conv, notification})
+			}
+		}
+	}
+	m.activity = activity
+
+	if m.digestThreshold > 0 && uint(len(pending)) > m.digestThreshold {
+		convs := make([]*NextcloudSpreedConversationData, 0, len(pending))
+		for _, p := range pending {
+			convs = append(convs, p.conv)
+		}
+		m.sendDigestNotification(convs, activeSettings.PlayNotificationSounds)
+	} else {
+		for _, p := range pending {
+			m.expandUnreadTail(ctx, p.conv, &p.notification)
+
+			result, err := m.sendMessageNotification(p.notification)
+			if err != nil {
+				continue
 			}
+
+			convLocal := m.conversationData[p.conv.Id]
+			convLocal.notificationHandle = result.Handle
+			m.conversationData[p.conv.Id] = convLocal
+		}
+	}
+	for _, p := range watchlistPending {
+		result, err := m.sendMessageNotification(p.notification)
+		if err != nil {
+			continue
+		}
+
+		convLocal := m.conversationData[p.conv.Id]
+		convLocal.notificationHandle = result.Handle
+		m.conversationData[p.conv.Id] = convLocal
+	}
+	if filteredCount == 0 && m.digestHandle != "" {
+		if err := m.withdrawMessageNotification(m.digestHandle); err == nil {
+			m.digestHandle = ""
 		}
 	}
 	if m.notificationCountSetter != nil {
 		m.notificationCountSetter(m.ncInstance.instanceName, unfilteredCount, filteredCount)
 	}
 
-	return APISuccess, nil
+	return nil
+}
+
+// Replaces the notification body with the last few unread messages
+// when more than one message arrived since the conversation was last read.
+func (m *Monitor) expandUnreadTail(ctx context.Context, conv *NextcloudSpreedConversationData, notification *Notification) {
+	if conv.UnreadMessages <= 1 {
+		return
+	}
+
+	limit := min(conv.UnreadMessages, maxUnreadTailLength)
+	messages, err := m.ncInstance.GetChatMessages(ctx, conv.Token, int(limit))
+	if err != nil {
+		// Falls back to the last message alone, below.
+		messages = &[]NextcloudSpreedMessageData{}
+	}
+
+	// Messages are returned newest first.
+	lines := make([]string, 0, maxPreviewLines)
+	for _, msg := range *messages {
+		if len(lines) >= maxPreviewLines {
+			break
+		}
+		if msg.SystemMessage != "" || (isOwnMessage(conv, &msg) && ClassifyConversation(conv) != ConversationNoteToSelf) {
+			continue
+		}
+
+		if ClassifyConversation(conv) == ConversationOneToOne {
+			lines = append(lines, msg.format())
+		} else {
+			lines = append(lines, msg.ActorDisplayName+": "+msg.format())
+		}
+	}
+	if len(lines) == 0 {
+		// Nothing to show among them, e.g. only system messages: fall back to the last message alone.
+		notification.Message = fmt.Sprintf("%d new messages\n%s", conv.UnreadMessages, notification.Message)
+		return
+	}
+	for a, b := 0, len(lines)-1; a < b; a, b = a+1, b-1 {
+		lines[a], lines[b] = lines[b], lines[a]
+	}
+
+	notification.Message = fmt.Sprintf("%d new messages\n%s", conv.UnreadMessages, strings.Join(lines, "\n"))
+}
+
+// Sends a single notification summarizing several conversations at once.
+// Per-conversation notifications are withdrawn, since the digest supersedes them.
+func (m *Monitor) sendDigestNotification(convs []*NextcloudSpreedConversationData, playAudio bool) {
+	lines := make([]string, 0, maxDigestLines+1)
+	urgency := UrgencyNormal
+	mention := false
+	for idx, conv := range convs {
+		if conv.UnreadMentionDirect || ClassifyConversation(conv) == ConversationOneToOne {
+			urgency = UrgencyCritical
+		}
+		mention = mention || conv.UnreadMention
+
+		if idx < maxDigestLines {
+			lines = append(lines, fmt.Sprintf("%s (%d)", conv.DisplayName, conv.UnreadMessages))
+		}
+
+		convLocal := m.conversationData[conv.Id]
+		if convLocal.notificationHandle != "" {
+			if err := m.withdrawMessageNotification(convLocal.notificationHandle); err == nil {
+				convLocal.notificationHandle = ""
+				m.conversationData[conv.Id] = convLocal
+			}
+		}
+	}
+	if len(convs) > maxDigestLines {
+		lines = append(lines, fmt.Sprintf("and %d more", len(convs)-maxDigestLines))
+	}
+
+	result, err := m.sendMessageNotification(Notification{
+		Title:     fmt.Sprintf("%d conversations with new messages", len(convs)),
+		Message:   strings.Join(lines, "\n"),
+		URL:       m.ncInstance.GetBaseURL() + "/apps/spreed/",
+		PlayAudio: playAudio,
+		Mention:   mention,
+		Urgency:   urgency,
+		Category:  CategoryDigest,
+		Replaces:  m.digestHandle,
+	})
+	if err == nil {
+		m.digestHandle = result.Handle
+	}
+}
+
+// Looks for watchlist matches among the messages that arrived since the last scan.
+// Returns a notification highlighting the most recent match, if any.
+func (m *Monitor) scanWatchlist(ctx context.Context, conv *NextcloudSpreedConversationData, convLocal *conversationLocalStorage, playAudio bool) (Notification, bool) {
+	if m.watchlist.Empty() {
+		return Notification{}, false
+	}
+
+	since := max(convLocal.lastScannedMessageId, conv.LastReadMessage)
+	if conv.LastMessage.Id <= since {
+		return Notification{}, false
+	}
+
+	limit := min(conv.UnreadMessages, maxWatchlistScan)
+	messages, err := m.ncInstance.GetChatMessages(ctx, conv.Token, int(limit))
+	if err != nil {
+		// Try again on the next check.
+		return Notification{}, false
+	}
+	convLocal.lastScannedMessageId = conv.LastMessage.Id
+
+	// Messages are returned newest first.
+	for _, msg := range *messages {
+		if msg.Id <= since {
+			break
+		}
+		if msg.SystemMessage != "" || isOwnMessage(conv, &msg) {
+			continue
+		}
+
+		text := msg.format()
+		match, ok := m.watchlist.Match(text)
+		if !ok {
+			continue
+		}
+
+		notification := m.newMessageNotification(conv, playAudio)
+		notification.Title = fmt.Sprintf("«%s» in %s", match.Text, conv.DisplayName)
+		notification.Message = msg.ActorDisplayName + ": " + text[:match.Start] + "«" + match.Text + "»" + text[match.End:]
+		notification.MessageId = msg.Id
+		notification.ActorType = msg.ActorType
+		notification.ActorId = msg.ActorId
+		notification.ActorDisplayName = msg.ActorDisplayName
+		notification.Category = CategoryWatchlist
+		return notification, true
+	}
+
+	return Notification{}, false
 }
@@ -0,0 +1,237 @@
+package nc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A server with a single group conversation, whose last message id is read from lastMessage.
+// Each message is activity in the conversation, reading it isn't: like Talk, modifiedSince only returns
+// the conversation after a new message. Marking the conversation as read clears its unread messages.
+type monitorServer struct {
+	*httptest.Server
+	lastMessage atomic.Int64
+	read        atomic.Bool
+	left        atomic.Bool  // The user left the conversation: it isn't listed anymore
+	fullFetches atomic.Int64 // Requests for the whole list
+}
+
+func newMonitorServer(t *testing.T) *monitorServer {
+	s := &monitorServer{}
+	s.lastMessage.Store(1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ocs/v2.php/apps/spreed/api/v4/room", func(w http.ResponseWriter, r *http.Request) {
+		room := benchmarkRooms(1)[0]
+		room.UnreadMessages = 1
+		if s.read.Load() {
+			room.UnreadMessages = 0
+		}
+		room.LastMessage.Id = s.lastMessage.Load()
+		room.LastActivity = 1700000000 + room.LastMessage.Id
+
+		res := NextcloudOCSBaseResult[[]NextcloudSpreedConversationData]{}
+		res.OCS.Meta.Status = "ok"
+		res.OCS.Meta.StatusCode = 200
+		res.OCS.Data = []NextcloudSpreedConversationData{}
+		since, _ := strconv.ParseInt(r.URL.Query().Get("modifiedSince"), 10, 64)
+		if since == 0 {
+			s.fullFetches.Add(1)
+		}
+		if room.LastActivity >= since && !s.left.Load() {
+			res.OCS.Data = append(res.OCS.Data, room)
+		}
+
+		w.Header().Set("X-Nextcloud-Talk-Hash", "0123456789abcdef")
+		w.Header().Set("X-Nextcloud-Talk-Modified-Before", strconv.FormatInt(room.LastActivity+1, 10))
+		json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("POST /ocs/v2.php/apps/spreed/api/v1/chat/room0000/read", func(w http.ResponseWriter, r *http.Request) {
+		s.read.Store(true)
+		w.Write([]byte(`{"ocs":{"meta":{"status":"ok","statuscode":200},"data":[]}}`))
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Records the notifications sent and withdrawn by a monitor.
+type notificationRecorder struct {
+	sent      []Notification
+	withdrawn []NotificationHandle
+}
+
+func newRecordingMonitor(instance *Instance) (*Monitor, *notificationRecorder) {
+	recorder := &notificationRecorder{}
+	monitor := NewMonitor(instance, 0)
+	monitor.SetNotificationSender(func(n Notification) (NotificationResult, error) {
+		recorder.sent = append(recorder.sent, n)
+		return NotificationResult{Handle: NotificationHandle(n.ConversationToken)}, nil
+	})
+	monitor.SetNotificationWithdrawer(func(instance string, handle NotificationHandle) error {
+		recorder.withdrawn = append(recorder.withdrawn, handle)
+		return nil
+	})
+	return monitor, recorder
+}
+
+func TestMonitorSnooze(t *testing.T) {
+	server := newMonitorServer(t)
+
+	monitor, recorder := newRecordingMonitor(NewInstance("test", server.URL))
+	ctx := context.Background()
+
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.sent) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(recorder.sent))
+	}
+
+	// A snoozed conversation loses its notification, and new messages don't bring it back.
+	monitor.Snooze("room0000", time.Now().Add(time.Hour))
+	server.lastMessage.Store(2)
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.sent) != 1 {
+		t.Errorf("got %d notifications while snoozed, want 1", len(recorder.sent))
+	}
+	if len(recorder.withdrawn) != 1 {
+		t.Errorf("got %d withdrawn notifications, want 1", len(recorder.withdrawn))
+	}
+
+	// Once the snooze is over, the latest message is notified.
+	monitor.Snooze("room0000", time.Now().Add(-time.Second))
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.sent) != 2 || recorder.sent[1].MessageId != 2 {
+		t.Errorf("got %d notifications after the snooze, want the second one for message 2", len(recorder.sent))
+	}
+}
+
+func TestMarkConversationRead(t *testing.T) {
+	server := newMonitorServer(t)
+
+	monitor, recorder := newRecordingMonitor(NewInstance("test", server.URL))
+	ctx := context.Background()
+
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := monitor.MarkConversationRead(ctx, "room0000"); err != nil {
+		t.Fatal(err)
+	}
+	if !server.read.Load() {
+		t.Error("the conversation wasn't marked as read on the server")
+	}
+
+	// The next check sees the conversation read, and withdraws its notification.
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.withdrawn) != 1 || recorder.withdrawn[0] != "room0000" {
+		t.Errorf("got withdrawn %v, want the notification of room0000", recorder.withdrawn)
+	}
+}
+
+// Reading a conversation on another client doesn't make it show up in the incremental list:
+// its notification is withdrawn by the next full fetch all the same.
+func TestReadElsewhereWithdrawsNotification(t *testing.T) {
+	server := newMonitorServer(t)
+
+	monitor, recorder := newRecordingMonitor(NewInstance("test", server.URL))
+	ctx := context.Background()
+
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.sent) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(recorder.sent))
+	}
+
+	server.read.Store(true)
+	for range readWatchInterval {
+		if err := monitor.ProcessMessages(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(recorder.withdrawn) != 1 || recorder.withdrawn[0] != "room0000" {
+		t.Errorf("got withdrawn %v, want the notification of room0000", recorder.withdrawn)
+	}
+	// Only every readWatchInterval fetches is a full one while the notification is shown.
+	if got := server.fullFetches.Load(); got != 2 {
+		t.Errorf("got %d full fetches, want 2", got)
+	}
+}
+
+// A conversation the user left disappears from the list: its notification is withdrawn,
+// and the following checks go back to incremental fetches.
+func TestLeftConversationWithdrawsNotification(t *testing.T) {
+	server := newMonitorServer(t)
+
+	monitor, recorder := newRecordingMonitor(NewInstance("test", server.URL))
+	ctx := context.Background()
+
+	if err := monitor.ProcessMessages(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	server.left.Store(true)
+	for range readWatchInterval {
+		if err := monitor.ProcessMessages(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(recorder.withdrawn) != 1 || recorder.withdrawn[0] != "room0000" {
+		t.Errorf("got withdrawn %v, want the notification of room0000", recorder.withdrawn)
+	}
+
+	fullFetches := server.fullFetches.Load()
+	for range readWatchInterval {
+		if err := monitor.ProcessMessages(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.fullFetches.Load(); got != fullFetches {
+		t.Errorf("got %d more full fetches without any notification shown, want none", got-fullFetches)
+	}
+}
+
+// A tail of system messages leaves nothing to preview: the notification keeps the last message.
+func TestUnreadTailOfSystemMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := NextcloudOCSBaseResult[[]NextcloudSpreedMessageData]{}
+		res.OCS.Meta.Status = "ok"
+		res.OCS.Meta.StatusCode = 200
+		for id := range int64(3) {
+			res.OCS.Data = append(res.OCS.Data, NextcloudSpreedMessageData{
+				Id:            10 - id,
+				ActorType:     "users",
+				ActorId:       "bob",
+				Message:       "{actor} joined the call",
+				SystemMessage: "call_joined",
+			})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(server.Close)
+
+	monitor := NewMonitor(NewInstance("test", server.URL), 0)
+	conv := benchmarkRooms(1)[0]
+	conv.UnreadMessages = 3
+	notification := Notification{Message: "Hello there"}
+
+	monitor.expandUnreadTail(context.Background(), &conv, &notification)
+	if want := "3 new messages\nHello there"; notification.Message != want {
+		t.Errorf("got %q, want %q", notification.Message, want)
+	}
+}
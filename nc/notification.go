@@ -0,0 +1,72 @@
+package nc
+
+type NotificationUrgency int64
+type NotificationCategory string
+type NotificationHandle string
+
+const (
+	UrgencyLow NotificationUrgency = iota
+	UrgencyNormal
+	UrgencyCritical
+)
+
+const (
+	CategoryMessage   NotificationCategory = "im.received"
+	CategoryDigest    NotificationCategory = "im.digest"
+	CategoryLogin     NotificationCategory = "im.login"
+	CategoryError     NotificationCategory = "im.error"
+	CategoryWatchlist NotificationCategory = "im.watchlist"
+)
+
+type Notification struct {
+	Instance string // Name of the instance that generated this notification
+	Account  string // Account the notification comes from, when several accounts share the instance
+
+	Title     string // Notification title, usually the conversation display name
+	Message   string // Notification body, usually a preview of the last message
+	URL       string // URL opened when the notification is activated
+	PlayAudio bool   // Whether the notification should play a sound
+
+	ConversationToken string // Token of the conversation this notification refers to
+	MessageId         int64  // Id of the message that triggered this notification
+	ActorType         string // Actor type of the message sender (users, guests, bots, bridged, ...)
+	ActorId           string // Actor id of the message sender
+	ActorDisplayName  string // Display name of the message sender
+	AvatarURL         string // URL of the conversation avatar, may require authentication
+	Mention           bool   // Whether the current user was mentioned
+
+	Urgency  NotificationUrgency
+	Category NotificationCategory
+
+	Replaces NotificationHandle // Handle of a previous notification that this one should update or replace
+
+	Actions []NotificationAction // Buttons shown along with the notification, when the backend supports them
+}
+
+// A button of a notification, opening its URL when clicked.
+type NotificationAction struct {
+	Label string
+	URL   string
+}
+
+type NotificationResult struct {
+	Handle NotificationHandle // Backend-specific handle, used to update or withdraw the notification later
+}
+
+type NotificationSender func(notification Notification) (NotificationResult, error)
+type NotificationWithdrawer func(instance string, handle NotificationHandle) error
+
+// Signature of the NotificationSender before the Notification struct was introduced.
+type LegacyNotificationSender func(instance string, title string, message string, url string, playAudio bool) error
+
+// Wraps a LegacyNotificationSender so that it can be used as a NotificationSender.
+// Legacy senders can't be updated or withdrawn, so the returned handle is always empty.
+func AdaptLegacyNotificationSender(sender LegacyNotificationSender) NotificationSender {
+	if sender == nil {
+		return nil
+	}
+
+	return func(notification Notification) (NotificationResult, error) {
+		return NotificationResult{}, sender(notification.Instance, notification.Title, notification.Message, notification.URL, notification.PlayAudio)
+	}
+}
@@ -0,0 +1,341 @@
+package nc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An OAuth2 client registered in the Nextcloud OAuth2 app.
+type OAuth2Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectPort int // Port of the loopback redirect URI registered for the client. 0 picks a free one.
+}
+
+// Access tokens are refreshed this long before they expire.
+const oauth2RefreshMargin = time.Minute
+
+var ErrTokenRefreshDisabled = errors.New("the access token expired, and only the running GoTalk may refresh it")
+
+type nextcloudOAuth2Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	UserID       string `json:"user_id"`
+}
+
+// Sets the OAuth2 client used to refresh the access token of OAuth2 credentials.
+func (i *Instance) SetOAuth2Config(config OAuth2Config) {
+	i.oauth2Config = config
+}
+
+func randomURLString(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Calls the token endpoint, for both the authorization code and the refresh token grants.
+// A rejected grant means the user has to log in again.
+func (i *Instance) requestOAuth2Token(ctx context.Context, form url.Values) (*AuthCredentials, error) {
+	form.Set("client_id", i.oauth2Config.ClientID)
+	form.Set("client_secret", i.oauth2Config.ClientSecret)
+
+	req, err := i.NewRequest(ctx, http.MethodPost, i.baseUrl+"/index.php/apps/oauth2/api/v1/token", bytes.NewReader([]byte(form.Encode())))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := i.do(req)
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		apiErr := newResponseError(resp)
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			apiErr.Kind = ErrorLoginExpired
+		}
+		return nil, apiErr
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+
+	token := nextcloudOAuth2Token{}
+	if err = json.Unmarshal(body, &token); err != nil {
+		return nil, newDecodeError(resp, err)
+	}
+	if token.AccessToken == "" || !strings.EqualFold(token.TokenType, "bearer") {
+		return nil, newDecodeError(resp, errors.New("no bearer token in the response"))
+	}
+
+	return &AuthCredentials{
+		LoginName:         token.UserID,
+		AccessToken:       token.AccessToken,
+		RefreshToken:      token.RefreshToken,
+		AccessTokenExpiry: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// Refreshes the access token when it's about to expire.
+// The new tokens go through the credentials update callback, like any other login.
+func (i *Instance) refreshAccessToken(ctx context.Context) error {
+	if i.credentials.RefreshToken == "" || time.Until(i.credentials.AccessTokenExpiry) > oauth2RefreshMargin {
+		return nil
+	}
+	if i.noTokenRefresh {
+		return ErrTokenRefreshDisabled
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", i.credentials.RefreshToken)
+
+	credentials, err := i.requestOAuth2Token(ctx, form)
+	if err != nil {
+		return err
+	}
+	if credentials.LoginName == "" {
+		credentials.LoginName = i.credentials.LoginName
+	}
+	if credentials.RefreshToken == "" {
+		credentials.RefreshToken = i.credentials.RefreshToken
+	}
+
+	i.SetCredentials(*credentials)
+	return nil
+}
+
+// Implements the OAuth2 authorization code grant with PKCE, through a loopback redirect.
+// Like LoginFlow, a flow is pending from Start until it succeeds, expires, gets cancelled or fails.
+type OAuth2Flow struct {
+	instance   *Instance
+	config     OAuth2Config
+	timeout    time.Duration
+	onProgress func(LoginFlowProgress)
+
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	finished chan struct{}
+	listener net.Listener
+	verifier string
+	state    string
+	redirect string
+	authURL  string
+	deadline time.Time
+	result   chan oauth2Result
+
+	mutex       sync.Mutex
+	flowState   LoginFlowState
+	credentials *AuthCredentials
+	err         error
+}
+
+type oauth2Result struct {
+	credentials *AuthCredentials
+	err         error
+}
+
+func (i *Instance) NewOAuth2Flow(config OAuth2Config) *OAuth2Flow {
+	return &OAuth2Flow{
+		instance: i,
+		config:   config,
+		timeout:  DefaultLoginFlowTimeout,
+	}
+}
+
+// How long the user has to log in. Must be set before Start.
+func (f *OAuth2Flow) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		f.timeout = timeout
+	}
+}
+
+// Sets a callback notified when the flow starts and when it ends. Must be set before Start.
+func (f *OAuth2Flow) OnProgress(callback func(LoginFlowProgress)) {
+	f.onProgress = callback
+}
+
+func (f *OAuth2Flow) State() LoginFlowState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.flowState
+}
+
+// The server URL the credentials belong to: always the instance itself.
+func (f *OAuth2Flow) ServerURL() string {
+	return ""
+}
+
+// Blocks until the flow ends, and returns its final state.
+// A flow that wasn't started, or failed to, fails with ErrLoginFlowNotStarted.
+func (f *OAuth2Flow) Wait() (LoginFlowState, *AuthCredentials, error) {
+	f.mutex.Lock()
+	finished := f.finished
+	f.mutex.Unlock()
+	if finished == nil {
+		return LoginFlowFailed, nil, ErrLoginFlowNotStarted
+	}
+	<-finished
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.flowState, f.credentials, f.err
+}
+
+// Cancels a pending flow. Safe to call more than once, or after the flow ended.
+func (f *OAuth2Flow) Cancel() {
+	if f.cancel != nil {
+		f.cancel(ErrLoginFlowCancelled)
+	}
+}
+
+// Starts listening for the redirect, and returns the authorization page to open in the browser.
+func (f *OAuth2Flow) Start(ctx context.Context) (string, error) {
+	if f.config.ClientID == "" {
+		return "", errors.New("no OAuth2 client configured")
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", f.config.RedirectPort))
+	if err != nil {
+		return "", err
+	}
+
+	f.instance.SetOAuth2Config(f.config)
+	f.listener = listener
+	f.redirect = fmt.Sprintf("http://%s/", listener.Addr().String())
+	f.verifier = randomURLString(32)
+	f.state = randomURLString(16)
+	challenge := sha256.Sum256([]byte(f.verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", f.config.ClientID)
+	query.Set("redirect_uri", f.redirect)
+	query.Set("state", f.state)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	f.authURL = f.instance.baseUrl + "/index.php/apps/oauth2/authorize?" + query.Encode()
+
+	f.ctx, f.cancel = context.WithCancelCause(ctx)
+	f.result = make(chan oauth2Result, 1)
+	f.deadline = time.Now().Add(f.timeout)
+
+	f.mutex.Lock()
+	f.finished = make(chan struct{})
+	f.flowState = LoginFlowPending
+	f.mutex.Unlock()
+
+	go f.run()
+
+	return f.authURL, nil
+}
+
+func (f *OAuth2Flow) reportProgress(state LoginFlowState) {
+	if f.onProgress == nil {
+		return
+	}
+	f.onProgress(LoginFlowProgress{
+		State:     state,
+		LoginURL:  f.authURL,
+		Remaining: max(time.Until(f.deadline), 0),
+	})
+}
+
+func (f *OAuth2Flow) run() {
+	server := &http.Server{
+		Handler:           http.HandlerFunc(f.handleRedirect),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go server.Serve(f.listener)
+
+	f.reportProgress(LoginFlowPending)
+
+	expired := time.NewTimer(time.Until(f.deadline))
+	defer expired.Stop()
+
+	state, credentials, err := LoginFlowFailed, (*AuthCredentials)(nil), error(nil)
+	select {
+	case result := <-f.result:
+		state, credentials, err = LoginFlowSucceeded, result.credentials, result.err
+		if err != nil {
+			state = LoginFlowFailed
+		}
+	case <-expired.C:
+		state, err = LoginFlowExpired, ErrLoginFlowExpired
+	case <-f.ctx.Done():
+		state, err = LoginFlowCancelled, context.Cause(f.ctx)
+	}
+
+	// Give the browser a moment to receive the final page.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	server.Shutdown(shutdownCtx)
+	cancel()
+
+	f.mutex.Lock()
+	f.flowState = state
+	f.credentials = credentials
+	f.err = err
+	f.mutex.Unlock()
+
+	f.cancel(nil)
+	f.reportProgress(state)
+	close(f.finished)
+}
+
+// Receives the browser once the user authorized GoTalk, and exchanges the code for tokens.
+func (f *OAuth2Flow) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("state") != f.state {
+		// Not our redirect: maybe another program, or a stale browser tab.
+		http.Error(w, "Unknown login request.", http.StatusBadRequest)
+		return
+	}
+
+	var result oauth2Result
+	if oauthErr := query.Get("error"); oauthErr != "" {
+		result.err = fmt.Errorf("the authorization was denied: %s", oauthErr)
+	} else if code := query.Get("code"); code == "" {
+		result.err = errors.New("the authorization returned no code")
+	} else {
+		form := url.Values{}
+		form.Set("grant_type", "authorization_code")
+		form.Set("code", code)
+		form.Set("redirect_uri", f.redirect)
+		form.Set("code_verifier", f.verifier)
+		result.credentials, result.err = f.instance.requestOAuth2Token(f.ctx, form)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if result.err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "GoTalk could not log in: "+result.err.Error())
+	} else {
+		fmt.Fprintln(w, "GoTalk is now logged in. You can close this page.")
+	}
+
+	select {
+	case f.result <- result:
+	default:
+		// Another redirect already ended the flow.
+	}
+}
@@ -0,0 +1,265 @@
+package nc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "gotalk-client"
+	testClientSecret = "gotalk-secret"
+)
+
+// A stand-in for the Nextcloud OAuth2 app.
+// The authorization endpoint approves every request right away.
+type oauth2Server struct {
+	*httptest.Server
+
+	mutex        sync.Mutex
+	challenge    string
+	redirectURI  string
+	accessToken  string
+	refreshToken string
+	issued       int
+}
+
+func newOAuth2Server(t *testing.T) *oauth2Server {
+	s := &oauth2Server{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /index.php/apps/oauth2/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.Lock()
+		s.challenge = query.Get("code_challenge")
+		s.redirectURI = query.Get("redirect_uri")
+		s.mutex.Unlock()
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code=the-code&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("POST /index.php/apps/oauth2/api/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if r.FormValue("client_id") != testClientID || r.FormValue("client_secret") != testClientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusBadRequest)
+			return
+		}
+
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			if r.FormValue("code") != "the-code" || r.FormValue("redirect_uri") != s.redirectURI ||
+				base64.RawURLEncoding.EncodeToString(verifier[:]) != s.challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		case "refresh_token":
+			if r.FormValue("refresh_token") != s.refreshToken {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+
+		s.issued++
+		s.accessToken = fmt.Sprintf("access-%d", s.issued)
+		s.refreshToken = fmt.Sprintf("refresh-%d", s.issued)
+		json.NewEncoder(w).Encode(nextcloudOAuth2Token{
+			AccessToken:  s.accessToken,
+			TokenType:    "Bearer",
+			ExpiresIn:    3600,
+			RefreshToken: s.refreshToken,
+			UserID:       "alice",
+		})
+	})
+	mux.HandleFunc("GET /ocs/v2.php/apps/spreed/api/v4/room", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		expected := "Bearer " + s.accessToken
+		s.mutex.Unlock()
+
+		if r.Header.Get("Authorization") != expected {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"ocs":{"meta":{"status":"ok","statuscode":200},"data":[]}}`))
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testOAuth2Config() OAuth2Config {
+	return OAuth2Config{ClientID: testClientID, ClientSecret: testClientSecret}
+}
+
+func TestOAuth2FlowSucceeds(t *testing.T) {
+	server := newOAuth2Server(t)
+	instance := NewInstance("test", server.URL)
+	flow := instance.NewOAuth2Flow(testOAuth2Config())
+
+	authURL, err := flow.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Plays the browser: the authorization page redirects to the loopback listener.
+	resp, err := http.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "logged in") {
+		t.Fatalf("unexpected redirect page %d: %s", resp.StatusCode, body)
+	}
+
+	state, credentials, err := flow.Wait()
+	if state != LoginFlowSucceeded || err != nil {
+		t.Fatalf("expected success, got %v (%v)", state, err)
+	}
+	if credentials.LoginName != "alice" || credentials.AccessToken != "access-1" || credentials.RefreshToken != "refresh-1" {
+		t.Fatalf("unexpected credentials %+v", credentials)
+	}
+	if !strings.HasPrefix(flow.redirect, "http://127.0.0.1:") {
+		t.Errorf("the redirect %s is not a loopback address", flow.redirect)
+	}
+}
+
+func TestOAuth2FlowIgnoresForeignRedirects(t *testing.T) {
+	server := newOAuth2Server(t)
+	flow := NewInstance("test", server.URL).NewOAuth2Flow(testOAuth2Config())
+
+	if _, err := flow.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(flow.redirect + "?code=the-code&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the forged redirect to be refused, got %d", resp.StatusCode)
+	}
+	if flow.State() != LoginFlowPending {
+		t.Fatalf("the flow ended with %v", flow.State())
+	}
+
+	flow.Cancel()
+	if state, _, _ := flow.Wait(); state != LoginFlowCancelled {
+		t.Fatalf("expected cancellation, got %v", state)
+	}
+}
+
+// Waiting on a flow that failed to start returns right away.
+func TestOAuth2FlowStartFails(t *testing.T) {
+	flow := NewInstance("test", "https://cloud.example.org").NewOAuth2Flow(OAuth2Config{})
+
+	if _, err := flow.Start(context.Background()); err == nil {
+		t.Fatal("started without a client ID")
+	}
+	if state, _, err := flow.Wait(); state != LoginFlowFailed || !errors.Is(err, ErrLoginFlowNotStarted) {
+		t.Errorf("expected a flow that wasn't started, got %v (%v)", state, err)
+	}
+}
+
+func TestOAuth2RefreshesExpiredTokens(t *testing.T) {
+	server := newOAuth2Server(t)
+	server.refreshToken = "refresh-0"
+
+	instance := NewInstance("test", server.URL)
+	instance.SetOAuth2Config(testOAuth2Config())
+	instance.SetCredentials(AuthCredentials{
+		LoginName:         "alice",
+		AccessToken:       "access-0",
+		RefreshToken:      "refresh-0",
+		AccessTokenExpiry: time.Now().Add(-time.Minute),
+	})
+
+	var updated AuthCredentials
+	instance.OnCredentialsUpdated(func(credentials AuthCredentials) {
+		updated = credentials
+	})
+
+	if _, err := instance.GetUserConversations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if updated.AccessToken != "access-1" || updated.RefreshToken != "refresh-1" || updated.LoginName != "alice" {
+		t.Fatalf("unexpected refreshed credentials %+v", updated)
+	}
+
+	// Still valid: no refresh this time.
+	if _, err := instance.GetUserConversations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if server.issued != 1 {
+		t.Errorf("expected a single refresh, got %d", server.issued)
+	}
+}
+
+// Another process owns the credentials: the refresh token must stay untouched.
+func TestOAuth2RefreshDisabled(t *testing.T) {
+	server := newOAuth2Server(t)
+	server.refreshToken = "refresh-0"
+
+	instance := NewInstance("test", server.URL)
+	instance.SetOAuth2Config(testOAuth2Config())
+	instance.SetCredentials(AuthCredentials{
+		LoginName:         "alice",
+		AccessToken:       "access-0",
+		RefreshToken:      "refresh-0",
+		AccessTokenExpiry: time.Now().Add(-time.Minute),
+	})
+	instance.DisableTokenRefresh()
+
+	if _, err := instance.GetUserConversations(context.Background()); !errors.Is(err, ErrTokenRefreshDisabled) {
+		t.Fatalf("got %v, want ErrTokenRefreshDisabled", err)
+	}
+	if server.issued != 0 {
+		t.Errorf("got %d refreshes, want none", server.issued)
+	}
+}
+
+func TestOAuth2RejectedRefreshExpiresTheLogin(t *testing.T) {
+	server := newOAuth2Server(t)
+	server.refreshToken = "refresh-0"
+
+	instance := NewInstance("test", server.URL)
+	instance.SetOAuth2Config(testOAuth2Config())
+	instance.SetCredentials(AuthCredentials{
+		LoginName:         "alice",
+		AccessToken:       "access-0",
+		RefreshToken:      "revoked",
+		AccessTokenExpiry: time.Now().Add(-time.Minute),
+	})
+
+	_, err := instance.GetUserConversations(context.Background())
+	if ErrorKindOf(err) != ErrorLoginExpired {
+		t.Fatalf("expected an expired login, got %v", err)
+	}
+
+	result, err := instance.ValidateCredentials(context.Background(), instance.GetCredentials())
+	if result != CredentialsExpired || err != nil {
+		t.Fatalf("expected expired credentials, got %v (%v)", result, err)
+	}
+}
@@ -0,0 +1,74 @@
+package nc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type ProxySettings struct {
+	URL string // Explicit proxy: http://, https:// or socks5:// URL
+	PAC string // URL or local path of a proxy auto-config file. Ignored when URL is set.
+}
+
+func newProxyFunc(settings ProxySettings) (func(*http.Request) (*url.URL, error), error) {
+	if settings.URL != "" {
+		proxyUrl, err := url.Parse(settings.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyUrl.Scheme)
+		}
+		return http.ProxyURL(proxyUrl), nil
+	}
+
+	if settings.PAC != "" {
+		return newPACProxyFunc(settings.PAC)
+	}
+
+	return http.ProxyFromEnvironment, nil
+}
+
+// Parses the first usable entry of a proxy list, as returned by a PAC file.
+// Entries look like "PROXY host:port", "SOCKS5 host:port" or "DIRECT",
+// while WinHTTP returns bare "host:port" entries.
+// Returns nil for a direct connection.
+func parseProxyList(list string) *url.URL {
+	for _, entry := range strings.Split(list, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var scheme, host string
+		switch {
+		case len(fields) == 1 && strings.EqualFold(fields[0], "DIRECT"):
+			return nil
+		case len(fields) < 2:
+			// Bare entry, as returned by WinHTTP.
+			scheme, host = "http", fields[0]
+		case strings.EqualFold(fields[0], "PROXY"), strings.EqualFold(fields[0], "HTTP"):
+			scheme, host = "http", fields[1]
+		case strings.EqualFold(fields[0], "HTTPS"):
+			scheme, host = "https", fields[1]
+		case strings.EqualFold(fields[0], "SOCKS"), strings.EqualFold(fields[0], "SOCKS5"):
+			scheme, host = "socks5", fields[1]
+		default:
+			// Bare entries, possibly separated by whitespace.
+			scheme, host = "http", fields[0]
+		}
+
+		// WinHTTP may prefix entries with the scheme they apply to ("https=host:port").
+		if _, after, ok := strings.Cut(host, "="); ok {
+			host = after
+		}
+		return &url.URL{Scheme: scheme, Host: host}
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package nc
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Without a JavaScript engine to evaluate it, a PAC file is ignored: the proxy environment variables are used instead.
+const PACSupported = false
+
+func newPACProxyFunc(pac string) (func(*http.Request) (*url.URL, error), error) {
+	return http.ProxyFromEnvironment, nil
+}
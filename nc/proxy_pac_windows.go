@@ -0,0 +1,127 @@
+//go:build windows
+
+package nc
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// PAC files are evaluated by WinHTTP, which ships a JavaScript engine for this exact purpose.
+const PACSupported = true
+
+const (
+	winhttpAccessTypeNoProxy   = 1
+	winhttpAutoProxyConfigUrl  = 0x00000002
+	winhttpAutoLogonChallenged = 1
+)
+
+var (
+	modWinHTTP                = windows.NewLazySystemDLL("winhttp.dll")
+	procWinHttpOpen           = modWinHTTP.NewProc("WinHttpOpen")
+	procWinHttpGetProxyForUrl = modWinHTTP.NewProc("WinHttpGetProxyForUrl")
+
+	modKernel32    = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalFree = modKernel32.NewProc("GlobalFree")
+)
+
+type winhttpAutoProxyOptions struct {
+	flags                 uint32
+	autoDetectFlags       uint32
+	autoConfigUrl         *uint16
+	reserved              uintptr
+	reservedFlags         uint32
+	autoLogonIfChallenged int32
+}
+
+type winhttpProxyInfo struct {
+	accessType  uint32
+	proxy       *uint16
+	proxyBypass *uint16
+}
+
+// WinHTTP only downloads PAC files over HTTP.
+// Local files are served from a loopback listener for the lifetime of the process.
+func servePACFile(path string) (string, error) {
+	content, err := os.ReadFile(strings.TrimPrefix(path, "file://"))
+	if err != nil {
+		return "", err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write(content)
+	}))
+
+	return "http://" + listener.Addr().String() + "/proxy.pac", nil
+}
+
+func newPACProxyFunc(pac string) (func(*http.Request) (*url.URL, error), error) {
+	pacUrl := pac
+	if !strings.HasPrefix(pac, "http://") && !strings.HasPrefix(pac, "https://") {
+		var err error
+		if pacUrl, err = servePACFile(pac); err != nil {
+			return nil, err
+		}
+	}
+
+	pacUrlPtr, err := windows.UTF16PtrFromString(pacUrl)
+	if err != nil {
+		return nil, err
+	}
+	agentPtr, err := windows.UTF16PtrFromString("GoTalk")
+	if err != nil {
+		return nil, err
+	}
+
+	session, _, err := procWinHttpOpen.Call(uintptr(unsafe.Pointer(agentPtr)), winhttpAccessTypeNoProxy, 0, 0, 0)
+	if session == 0 {
+		return nil, err
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		targetPtr, err := windows.UTF16PtrFromString(req.URL.String())
+		if err != nil {
+			return nil, err
+		}
+
+		options := winhttpAutoProxyOptions{
+			flags:                 winhttpAutoProxyConfigUrl,
+			autoConfigUrl:         pacUrlPtr,
+			autoLogonIfChallenged: winhttpAutoLogonChallenged,
+		}
+		var info winhttpProxyInfo
+
+		ok, _, err := procWinHttpGetProxyForUrl.Call(session, uintptr(unsafe.Pointer(targetPtr)), uintptr(unsafe.Pointer(&options)), uintptr(unsafe.Pointer(&info)))
+		runtime.KeepAlive(pacUrlPtr)
+		runtime.KeepAlive(targetPtr)
+		if ok == 0 {
+			return nil, err
+		}
+
+		if info.proxyBypass != nil {
+			procGlobalFree.Call(uintptr(unsafe.Pointer(info.proxyBypass)))
+		}
+		if info.proxy == nil {
+			return nil, nil
+		}
+		defer procGlobalFree.Call(uintptr(unsafe.Pointer(info.proxy)))
+
+		if info.accessType == winhttpAccessTypeNoProxy {
+			return nil, nil
+		}
+		return parseProxyList(windows.UTF16PtrToString(info.proxy)), nil
+	}, nil
+}
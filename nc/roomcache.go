@@ -0,0 +1,103 @@
+package nc
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Incremental fetches miss conversations the user left, or read from another client:
+// the whole list is fetched again this often.
+const fullRoomRefreshInterval = time.Minute * 2
+
+// While a notification is shown, every this many fetches is a full one, to notice reads on other clients.
+const readWatchInterval = 3
+
+// The conversations of the user, kept up to date with incremental fetches.
+type roomCache struct {
+	rooms           map[string]NextcloudSpreedConversationData // By token
+	sorted          []NextcloudSpreedConversationData          // Most recent activity first
+	hash            string
+	modifiedBefore  int64
+	lastFullRefresh time.Time
+	sinceFull       int // Incremental fetches since the last full one
+}
+
+func (c *roomCache) needsFullRefresh() bool {
+	return c.modifiedBefore == 0 || time.Since(c.lastFullRefresh) >= fullRoomRefreshInterval
+}
+
+// Fetches the conversations changed since the last call, merges them into the cache
+// and returns every known conversation, and whether the whole list was fetched.
+// watchReads asks for the whole list every readWatchInterval fetches: modifiedSince filters on the last activity,
+// which reading a conversation doesn't change, so only the whole list tells whether a notified conversation
+// was read on another client.
+// The returned slice is shared with the cache, and must not be modified.
+func (c *roomCache) refresh(ctx context.Context, instance *Instance, watchReads bool) ([]NextcloudSpreedConversationData, bool, error) {
+	full := c.needsFullRefresh() || (watchReads && c.sinceFull+1 >= readWatchInterval)
+
+	var since int64 = 0
+	if !full {
+		since = c.modifiedBefore
+	}
+
+	list, err := instance.GetUserConversationsSince(ctx, since)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !full && list.Hash != c.hash {
+		// The server configuration changed: start over.
+		full = true
+		if list, err = instance.GetUserConversationsSince(ctx, 0); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if full {
+		c.rooms = make(map[string]NextcloudSpreedConversationData, len(list.Conversations))
+		c.lastFullRefresh = time.Now()
+		c.sinceFull = 0
+	} else {
+		c.sinceFull++
+	}
+	for _, room := range list.Conversations {
+		c.rooms[room.Token] = room
+	}
+	c.hash = list.Hash
+	c.modifiedBefore = list.ModifiedBefore
+
+	if full || len(list.Conversations) > 0 {
+		c.sort()
+	}
+	return c.sorted, full, nil
+}
+
+// Clears the unread messages of a conversation read through GoTalk, until the server lists it again.
+func (c *roomCache) markRead(token string) {
+	room, ok := c.rooms[token]
+	if !ok {
+		return
+	}
+	room.UnreadMessages = 0
+	room.UnreadMention = false
+	room.UnreadMentionDirect = false
+	c.rooms[token] = room
+	c.sort()
+}
+
+func (c *roomCache) sort() {
+	c.sorted = c.sorted[:0]
+	for _, room := range c.rooms {
+		c.sorted = append(c.sorted, room)
+	}
+
+	slices.SortFunc(c.sorted, func(a, b NextcloudSpreedConversationData) int {
+		return cmp.Or(
+			cmp.Compare(b.LastActivity, a.LastActivity),
+			strings.Compare(a.Token, b.Token),
+		)
+	})
+}
@@ -0,0 +1,140 @@
+package nc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const benchmarkRoomCount = 500
+
+func benchmarkRooms(count int) []NextcloudSpreedConversationData {
+	rooms := make([]NextcloudSpreedConversationData, count)
+	for i := range rooms {
+		rooms[i] = NextcloudSpreedConversationData{
+			Id:             int64(i + 1),
+			Token:          fmt.Sprintf("room%04d", i),
+			Type:           roomTypeGroup,
+			Name:           fmt.Sprintf("Room %d", i),
+			DisplayName:    fmt.Sprintf("Room %d", i),
+			LastActivity:   int64(1700000000 + i),
+			UnreadMessages: int64(i % 3),
+			LastMessage: NextcloudSpreedMessageData{
+				Id:               int64(i * 10),
+				Token:            fmt.Sprintf("room%04d", i),
+				ActorType:        "users",
+				ActorId:          "alice",
+				ActorDisplayName: "Alice",
+				Message:          "Hello there, this is a message of average length.",
+				MessageType:      "comment",
+			},
+		}
+	}
+	return rooms
+}
+
+func encodeRooms(b *testing.B, rooms []NextcloudSpreedConversationData) []byte {
+	res := NextcloudOCSBaseResult[[]NextcloudSpreedConversationData]{}
+	res.OCS.Meta.Status = "ok"
+	res.OCS.Meta.StatusCode = 200
+	res.OCS.Data = rooms
+
+	body, err := json.Marshal(res)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body
+}
+
+// Serves every room to full requests, and a single changed room to incremental ones.
+// Responses are encoded upfront, so that the server barely shows up in the allocations.
+func newRoomListServer(b *testing.B, sent *atomic.Int64) *httptest.Server {
+	rooms := benchmarkRooms(benchmarkRoomCount)
+	full := encodeRooms(b, rooms)
+	delta := encodeRooms(b, rooms[:1])
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := full
+		if r.URL.Query().Get("modifiedSince") != "" {
+			body = delta
+		}
+
+		w.Header().Set("X-Nextcloud-Talk-Hash", "0123456789abcdef")
+		w.Header().Set("X-Nextcloud-Talk-Modified-Before", "1700001000")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		sent.Add(int64(len(body)))
+	}))
+}
+
+func BenchmarkRoomListFull(b *testing.B) {
+	var sent atomic.Int64
+	server := newRoomListServer(b, &sent)
+	defer server.Close()
+
+	instance := NewInstance("bench", server.URL)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := instance.GetUserConversations(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(sent.Load())/float64(b.N), "resp-bytes/poll")
+}
+
+func BenchmarkRoomListIncremental(b *testing.B) {
+	var sent atomic.Int64
+	server := newRoomListServer(b, &sent)
+	defer server.Close()
+
+	instance := NewInstance("bench", server.URL)
+	ctx := context.Background()
+
+	// The first poll fetches every room: only the following ones are measured.
+	cache := roomCache{}
+	if _, _, err := cache.refresh(ctx, instance, false); err != nil {
+		b.Fatal(err)
+	}
+	sent.Store(0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		rooms, _, err := cache.refresh(ctx, instance, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(rooms) != benchmarkRoomCount {
+			b.Fatalf("expected %d rooms, got %d", benchmarkRoomCount, len(rooms))
+		}
+	}
+	b.ReportMetric(float64(sent.Load())/float64(b.N), "resp-bytes/poll")
+}
+
+// A conversation read through GoTalk stays read in the cache, even if incremental fetches don't list it again.
+func TestRoomCacheMarkRead(t *testing.T) {
+	server := newMonitorServer(t)
+	instance := NewInstance("test", server.URL)
+	ctx := context.Background()
+
+	cache := roomCache{}
+	if _, _, err := cache.refresh(ctx, instance, false); err != nil {
+		t.Fatal(err)
+	}
+	cache.markRead("room0000")
+
+	rooms, _, err := cache.refresh(ctx, instance, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].UnreadMessages != 0 {
+		t.Errorf("got %+v, want room0000 without unread messages", rooms)
+	}
+}
@@ -2,40 +2,124 @@ package nc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
-func (i *Instance) GetUserConversations() (*[]NextcloudSpreedConversationData, APIResponse, error) {
-	req, err := i.NewOCSRequest(http.MethodGet, i.baseUrl+"/ocs/v2.php/apps/spreed/api/v4/room", bytes.NewReader([]byte("")))
+type ConversationList struct {
+	Conversations  []NextcloudSpreedConversationData
+	Hash           string // X-Nextcloud-Talk-Hash: changes along with the server configuration
+	ModifiedBefore int64  // X-Nextcloud-Talk-Modified-Before: the modifiedSince of the next request, 0 if not supported
+}
+
+func (i *Instance) GetUserConversations(ctx context.Context) (*[]NextcloudSpreedConversationData, error) {
+	list, err := i.GetUserConversationsSince(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &list.Conversations, nil
+}
+
+// Returns the conversations modified since the given timestamp, or all of them if modifiedSince is 0.
+// Conversations the user left are only noticed by asking for all of them.
+func (i *Instance) GetUserConversationsSince(ctx context.Context, modifiedSince int64) (*ConversationList, error) {
+	reqUrl := i.baseUrl + "/ocs/v2.php/apps/spreed/api/v4/room"
+	if modifiedSince > 0 {
+		reqUrl += "?modifiedSince=" + strconv.FormatInt(modifiedSince, 10)
+	}
+
+	req, err := i.NewOCSRequest(ctx, http.MethodGet, reqUrl, bytes.NewReader([]byte("")))
 	if err != nil {
-		return nil, APIUnreachable, err
+		return nil, err
 	}
-	req.SetBasicAuth(i.credentials.LoginName, i.credentials.AppPassword)
 
-	resp, err := i.client.Do(req)
+	resp, err := i.do(req)
 	if err != nil {
-		return nil, APIUnreachable, err
+		return nil, newRequestError(err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 401 {
-		return nil, APILoginExpired, nil
-	} else if resp.StatusCode != 200 {
-		return nil, APIUnreachable, errors.New("unknown server response")
+	if resp.StatusCode != 200 {
+		return nil, newResponseError(resp)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, APIUnreachable, err
+		return nil, newRequestError(err)
 	}
 
 	ncRes := NextcloudOCSBaseResult[[]NextcloudSpreedConversationData]{}
 	if err = json.Unmarshal(body, &ncRes); err != nil {
-		return nil, APIUnreachable, err
+		return nil, newDecodeError(resp, err)
+	}
+
+	modifiedBefore, _ := strconv.ParseInt(resp.Header.Get("X-Nextcloud-Talk-Modified-Before"), 10, 64)
+
+	return &ConversationList{
+		Conversations:  ncRes.OCS.Data,
+		Hash:           resp.Header.Get("X-Nextcloud-Talk-Hash"),
+		ModifiedBefore: modifiedBefore,
+	}, nil
+}
+
+// Returns up to limit messages of a conversation, newest first.
+// The read marker is left untouched, so the conversation stays unread.
+func (i *Instance) GetChatMessages(ctx context.Context, token string, limit int) (*[]NextcloudSpreedMessageData, error) {
+	query := url.Values{}
+	query.Set("lookIntoFuture", "0")
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("setReadMarker", "0")
+	query.Set("markNotificationsAsRead", "0")
+
+	req, err := i.NewOCSRequest(ctx, http.MethodGet, i.baseUrl+"/ocs/v2.php/apps/spreed/api/v1/chat/"+url.PathEscape(token)+"?"+query.Encode(), bytes.NewReader([]byte("")))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := i.do(req)
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 304 {
+		return &[]NextcloudSpreedMessageData{}, nil
+	} else if resp.StatusCode != 200 {
+		return nil, newResponseError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+
+	ncRes := NextcloudOCSBaseResult[[]NextcloudSpreedMessageData]{}
+	if err = json.Unmarshal(body, &ncRes); err != nil {
+		return nil, newDecodeError(resp, err)
 	}
 
-	return &ncRes.OCS.Data, APISuccess, nil
+	return &ncRes.OCS.Data, nil
+}
+
+// Moves the read marker of a conversation to its last message, which also clears its notifications on the server.
+func (i *Instance) MarkConversationRead(ctx context.Context, token string) error {
+	req, err := i.NewOCSRequest(ctx, http.MethodPost, i.baseUrl+"/ocs/v2.php/apps/spreed/api/v1/chat/"+url.PathEscape(token)+"/read", bytes.NewReader([]byte("")))
+	if err != nil {
+		return err
+	}
+
+	resp, err := i.do(req)
+	if err != nil {
+		return newRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return newResponseError(resp)
+	}
+	return nil
 }
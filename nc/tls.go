@@ -0,0 +1,141 @@
+package nc
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type TLSSettings struct {
+	CAFiles        []string // PEM bundles trusted in addition to the system roots
+	PinnedSPKI     []string // Base64 SHA-256 hashes of trusted public keys. When set, one certificate of the chain must match.
+	ClientCertFile string   // PEM client certificate, for mutual TLS
+	ClientKeyFile  string   // PEM private key of the client certificate
+	MinVersion     string   // Minimum TLS version: "1.0", "1.1", "1.2" or "1.3". Defaults to "1.2".
+}
+
+// Returned when the server certificate is valid, but its public key isn't pinned.
+type CertificatePinError struct {
+	Host string
+}
+
+func (e *CertificatePinError) Error() string {
+	return fmt.Sprintf("the certificate presented by %s does not match any pinned public key", e.Host)
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// Accepts both plain base64 hashes and the "sha256//" prefix used by curl and HPKP.
+func parseSPKIPin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256//")
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key pin %q: %w", pin, err)
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid public key pin %q: not a SHA-256 hash", pin)
+	}
+	return hash, nil
+}
+
+func newTLSConfig(settings TLSSettings) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(settings.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: minVersion,
+	}
+
+	if len(settings.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, file := range settings.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", file)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if settings.ClientCertFile != "" || settings.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.ClientCertFile, settings.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(settings.PinnedSPKI) > 0 {
+		pins := make([][]byte, 0, len(settings.PinnedSPKI))
+		for _, pin := range settings.PinnedSPKI {
+			hash, err := parseSPKIPin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, hash)
+		}
+
+		// Runs after the regular chain verification, which stays in place.
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if string(hash[:]) == string(pin) {
+						return nil
+					}
+				}
+			}
+			return &CertificatePinError{Host: state.ServerName}
+		}
+	}
+
+	return config, nil
+}
+
+// Whether the error comes from a rejected server certificate,
+// as opposed to a network failure.
+func IsCertificateError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var pinErr *CertificatePinError
+
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		errors.As(err, &pinErr)
+}
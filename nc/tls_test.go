@@ -0,0 +1,157 @@
+package nc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the certificate of a test server to a PEM file, to trust it as a CA.
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func serverPin(server *httptest.Server) string {
+	hash := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Sends a GET request to the server through an instance using the given settings.
+func getWithSettings(t *testing.T, url string, settings HTTPSettings) error {
+	instance := NewInstance("test", url)
+	settings.MaxRetries = -1
+	if err := instance.SetHTTPSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := instance.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func newTLSTestServer(t *testing.T, maxVersion uint16) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: maxVersion}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTLSSettings(t *testing.T) {
+	server := newTLSTestServer(t, 0)
+	ca := writeServerCA(t, server)
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name     string
+		settings TLSSettings
+		wantErr  bool
+		wantPin  bool // Whether the error must be a pin mismatch
+	}{
+		{"untrusted certificate", TLSSettings{}, true, false},
+		{"custom CA", TLSSettings{CAFiles: []string{ca}}, false, false},
+		{"matching pin", TLSSettings{CAFiles: []string{ca}, PinnedSPKI: []string{otherPin, serverPin(server)}}, false, false},
+		{"matching pin with a prefix", TLSSettings{CAFiles: []string{ca}, PinnedSPKI: []string{"sha256//" + serverPin(server)}}, false, false},
+		{"mismatching pin", TLSSettings{CAFiles: []string{ca}, PinnedSPKI: []string{otherPin}}, true, true},
+		// Pinning comes on top of the chain verification, it doesn't replace it.
+		{"matching pin without a trusted CA", TLSSettings{PinnedSPKI: []string{serverPin(server)}}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := getWithSettings(t, server.URL, HTTPSettings{TLS: tt.settings})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			if !IsCertificateError(err) {
+				t.Errorf("got %v, want a certificate error", err)
+			}
+			var pinErr *CertificatePinError
+			if tt.wantPin != errors.As(err, &pinErr) {
+				t.Errorf("got %v, want a pin error: %v", err, tt.wantPin)
+			}
+		})
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	server := newTLSTestServer(t, tls.VersionTLS12)
+	ca := writeServerCA(t, server)
+
+	if err := getWithSettings(t, server.URL, HTTPSettings{TLS: TLSSettings{CAFiles: []string{ca}}}); err != nil {
+		t.Errorf("TLS 1.2 server with the default minimum: %v", err)
+	}
+	if err := getWithSettings(t, server.URL, HTTPSettings{TLS: TLSSettings{CAFiles: []string{ca}, MinVersion: "1.3"}}); err == nil {
+		t.Error("TLS 1.2 server accepted with MinVersion 1.3")
+	}
+}
+
+// Requests go through the configured proxy.
+func TestProxyURL(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	t.Cleanup(proxy.Close)
+
+	target := "http://cloud.example.invalid/status.php"
+	if err := getWithSettings(t, target, HTTPSettings{Proxy: ProxySettings{URL: proxy.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	if proxied != target {
+		t.Errorf("proxy got %q, want %q", proxied, target)
+	}
+}
+
+// Where PAC files can't be evaluated, the account keeps working with the proxy environment variables.
+func TestPACFallback(t *testing.T) {
+	if PACSupported {
+		t.Skip("PAC files are evaluated on this platform")
+	}
+	if err := NewInstance("test", "https://cloud.example.org").SetHTTPSettings(HTTPSettings{Proxy: ProxySettings{PAC: "http://wpad.example.org/proxy.pac"}}); err != nil {
+		t.Errorf("got %v, want a fallback to the environment", err)
+	}
+}
+
+// Settings that can't be applied are reported, rather than silently replaced with the defaults.
+func TestInvalidHTTPSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings HTTPSettings
+	}{
+		{"missing CA file", HTTPSettings{TLS: TLSSettings{CAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}}}},
+		{"invalid pin", HTTPSettings{TLS: TLSSettings{PinnedSPKI: []string{"not a hash"}}}},
+		{"unknown TLS version", HTTPSettings{TLS: TLSSettings{MinVersion: "2.0"}}},
+		{"missing client certificate", HTTPSettings{TLS: TLSSettings{ClientCertFile: "missing.pem", ClientKeyFile: "missing.key"}}},
+		{"unsupported proxy scheme", HTTPSettings{Proxy: ProxySettings{URL: "ftp://proxy.example.org"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewInstance("test", "https://cloud.example.org").SetHTTPSettings(tt.settings); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package nc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+type HTTPSettings struct {
+	DialTimeout           time.Duration // Maximum time to establish a TCP connection
+	TLSHandshakeTimeout   time.Duration // Maximum time to complete the TLS handshake
+	ResponseHeaderTimeout time.Duration // Maximum time to wait for the response headers once the request is sent
+	RequestTimeout        time.Duration // Maximum time for a whole request, body included
+
+	MaxRetries int           // How many times an idempotent request is retried after a transient failure. Negative disables retries.
+	RetryDelay time.Duration // Delay before the first retry, doubled on every attempt
+
+	TLS   TLSSettings
+	Proxy ProxySettings
+}
+
+func DefaultHTTPSettings() HTTPSettings {
+	return HTTPSettings{
+		DialTimeout:           time.Second * 10,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ResponseHeaderTimeout: time.Second * 20,
+		RequestTimeout:        time.Second * 30,
+		MaxRetries:            2,
+		RetryDelay:            time.Second,
+	}
+}
+
+// Replaces zero values with their defaults.
+func (s HTTPSettings) WithDefaults() HTTPSettings {
+	d := DefaultHTTPSettings()
+	if s.DialTimeout <= 0 {
+		s.DialTimeout = d.DialTimeout
+	}
+	if s.TLSHandshakeTimeout <= 0 {
+		s.TLSHandshakeTimeout = d.TLSHandshakeTimeout
+	}
+	if s.ResponseHeaderTimeout <= 0 {
+		s.ResponseHeaderTimeout = d.ResponseHeaderTimeout
+	}
+	if s.RequestTimeout <= 0 {
+		s.RequestTimeout = d.RequestTimeout
+	}
+	if s.MaxRetries < 0 {
+		s.MaxRetries = 0
+	} else if s.MaxRetries == 0 {
+		s.MaxRetries = d.MaxRetries
+	}
+	if s.RetryDelay <= 0 {
+		s.RetryDelay = d.RetryDelay
+	}
+	return s
+}
+
+func newHTTPTransport(settings HTTPSettings) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := newProxyFunc(settings.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   settings.DialTimeout,
+		KeepAlive: time.Second * 30,
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       time.Second * 90,
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+func newHTTPClient(settings HTTPSettings) (*http.Client, error) {
+	transport, err := newHTTPTransport(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   settings.RequestTimeout,
+	}, nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+}
+
+// Sends a request through the instance client.
+// Idempotent requests are retried with an exponential delay after network errors
+// or gateway failures, until the retries run out or the request context is canceled.
+func (i *Instance) do(req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req.Method) || i.httpSettings.MaxRetries == 0 {
+		return i.client.Do(req)
+	}
+
+	ctx := req.Context()
+	delay := i.httpSettings.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 {
+			attemptReq = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		resp, err := i.client.Do(attemptReq)
+		if attempt >= i.httpSettings.MaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+		delay *= 2
+	}
+}
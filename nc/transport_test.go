@@ -0,0 +1,114 @@
+package nc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A server failing the first failures requests, then answering 200.
+// A failure is the given status, or a dropped connection when status is 0.
+func newFlakyServer(t *testing.T, failures int64, status int, requests *atomic.Int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > failures {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTransportRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		failures   int64
+		status     int // Status of the failures, 0 for a network error
+		maxRetries int
+		requests   int64 // Expected number of requests
+		wantErr    bool
+		wantStatus int
+	}{
+		{"GET after a 502", http.MethodGet, 1, http.StatusBadGateway, 2, 2, false, http.StatusOK},
+		{"GET after a 504", http.MethodGet, 1, http.StatusGatewayTimeout, 2, 2, false, http.StatusOK},
+		{"GET after a network error", http.MethodGet, 2, 0, 2, 3, false, http.StatusOK},
+		{"GET until the retries run out", http.MethodGet, 5, http.StatusBadGateway, 2, 3, false, http.StatusBadGateway},
+		{"GET with retries disabled", http.MethodGet, 1, http.StatusBadGateway, -1, 1, false, http.StatusBadGateway},
+		{"GET after a 500", http.MethodGet, 1, http.StatusInternalServerError, 2, 1, false, http.StatusInternalServerError},
+		{"HEAD after a 502", http.MethodHead, 1, http.StatusBadGateway, 2, 2, false, http.StatusOK},
+		{"OPTIONS after a network error", http.MethodOptions, 1, 0, 2, 2, false, http.StatusOK},
+		{"POST after a 502", http.MethodPost, 1, http.StatusBadGateway, 2, 1, false, http.StatusBadGateway},
+		{"POST after a network error", http.MethodPost, 1, 0, 2, 1, true, 0},
+		{"DELETE after a 504", http.MethodDelete, 1, http.StatusGatewayTimeout, 2, 1, false, http.StatusGatewayTimeout},
+		{"DELETE after a network error", http.MethodDelete, 1, 0, 2, 1, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			server := newFlakyServer(t, tt.failures, tt.status, &requests)
+
+			instance := NewInstance("test", server.URL)
+			if err := instance.SetHTTPSettings(HTTPSettings{MaxRetries: tt.maxRetries, RetryDelay: time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), tt.method, server.URL, strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := instance.do(req)
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			if tt.wantErr != (err != nil) {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("got %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+// A canceled context stops the retries.
+func TestTransportRetryCanceled(t *testing.T) {
+	var requests atomic.Int64
+	server := newFlakyServer(t, 10, http.StatusBadGateway, &requests)
+
+	instance := NewInstance("test", server.URL)
+	if err := instance.SetHTTPSettings(HTTPSettings{MaxRetries: 5, RetryDelay: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.do(req); err == nil {
+		t.Error("got no error after the context was canceled")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
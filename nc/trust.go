@@ -0,0 +1,83 @@
+package nc
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Returned when the server points us to a URL that doesn't belong to the configured instance.
+type UntrustedURLError struct {
+	URL    string
+	Reason string
+}
+
+func (e *UntrustedURLError) Error() string {
+	return fmt.Sprintf("untrusted URL %s: %s", e.URL, e.Reason)
+}
+
+// Other host names or URLs of this instance, trusted along with the base URL.
+// Login flows may only point to one of them.
+func (i *Instance) SetTrustedAliases(aliases []string) {
+	i.trustedAliases = aliases
+}
+
+// Aliases may be plain host names, with or without a port, or whole URLs.
+func aliasHost(alias string) string {
+	alias = strings.TrimSpace(alias)
+	if strings.Contains(alias, "://") {
+		if u, err := url.Parse(alias); err == nil {
+			return u.Host
+		}
+	}
+	return strings.TrimRight(alias, "/")
+}
+
+func (i *Instance) isTrustedHost(u *url.URL) bool {
+	hosts := []string{}
+	if base, err := url.Parse(i.baseUrl); err == nil {
+		hosts = append(hosts, base.Host)
+	}
+	for _, alias := range i.trustedAliases {
+		hosts = append(hosts, aliasHost(alias))
+	}
+
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+		// A host without a port matches that host on the default port of the scheme.
+		if !strings.Contains(host, ":") && u.Port() == "" && strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that a URL received from the server belongs to this instance.
+// When the instance is reached through HTTPS, plain HTTP URLs on a trusted host are upgraded to HTTPS:
+// a reverse proxy forgetting to forward the protocol is far more common than a server without HTTPS.
+// Returns the URL to use.
+func (i *Instance) CheckTrustedURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", &UntrustedURLError{URL: raw, Reason: "not an absolute URL"}
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", &UntrustedURLError{URL: raw, Reason: "unsupported scheme " + u.Scheme}
+	}
+	if u.User != nil {
+		return "", &UntrustedURLError{URL: raw, Reason: "embedded credentials"}
+	}
+	if !i.isTrustedHost(u) {
+		return "", &UntrustedURLError{URL: raw, Reason: "the host is neither the instance nor one of its aliases"}
+	}
+
+	if base, err := url.Parse(i.baseUrl); err == nil && base.Scheme == "https" && u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	return u.String(), nil
+}
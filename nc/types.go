@@ -1,12 +1,23 @@
 package nc
 
+import "time"
+
 type CredentialValidationResult int64
-type APIResponse int64
-type LoginResult int64
+type LoginFlowState int64
 
 type AuthCredentials struct {
 	LoginName   string
 	AppPassword string
+
+	// OAuth2 credentials, used instead of the app password when set
+	AccessToken       string
+	RefreshToken      string
+	AccessTokenExpiry time.Time
+}
+
+// Whether the credentials come from OAuth2, and are sent as a bearer token.
+func (c AuthCredentials) IsOAuth2() bool {
+	return c.AccessToken != ""
 }
 
 const (
@@ -17,15 +28,23 @@ const (
 )
 
 const (
-	APIUnreachable APIResponse = iota
-	APIMaintenance
-	APILoginExpired
-	APISuccess
+	LoginFlowPending   LoginFlowState = iota // Waiting for the user to log in from the browser
+	LoginFlowSucceeded                       // The user logged in, the credentials are available
+	LoginFlowExpired                         // The user didn't log in before the timeout
+	LoginFlowCancelled                       // The flow was cancelled, or its context was done
+	LoginFlowFailed                          // The server rejected the flow, or sent an invalid answer
 )
 
-const (
-	LoginError LoginResult = iota
-	LoginPending
-	LoginFailed
-	LoginSuccessful
-)
+func (s LoginFlowState) String() string {
+	switch s {
+	case LoginFlowPending:
+		return "pending"
+	case LoginFlowSucceeded:
+		return "succeeded"
+	case LoginFlowExpired:
+		return "expired"
+	case LoginFlowCancelled:
+		return "cancelled"
+	}
+	return "failed"
+}
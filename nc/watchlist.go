@@ -0,0 +1,161 @@
+package nc
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type WatchlistEntry struct {
+	Pattern   string // Keyword, or regular expression if Regex is set
+	Regex     bool   // Whether Pattern is a regular expression
+	WholeWord bool   // Only match when the pattern is not part of a longer word
+}
+
+type watchlistMatcher struct {
+	entry WatchlistEntry
+	re    *regexp.Regexp
+}
+
+type Watchlist struct {
+	matchers []watchlistMatcher
+}
+
+type WatchlistMatch struct {
+	Entry WatchlistEntry
+	Text  string // The matched text, as it appears in the original message
+	Start int    // Byte offset of the match in the original message
+	End   int    // Byte offset right after the match in the original message
+}
+
+// Letters, digits and underscores make up a word, in any script.
+const (
+	wordBoundaryStart = `(?:^|[^\p{L}\p{N}_])(`
+	wordBoundaryEnd   = `)(?:$|[^\p{L}\p{N}_])`
+)
+
+// Lowercases a rune and strips its diacritics.
+// Combining marks fold to an empty string.
+func foldRune(r rune) string {
+	var sb strings.Builder
+	for _, d := range norm.NFD.String(string(r)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		sb.WriteRune(unicode.ToLower(d))
+	}
+	return sb.String()
+}
+
+// Folds a string for matching.
+// offsets[i] is the byte offset in s of the rune that produced byte i of the folded string,
+// with one extra entry pointing to the end of s.
+func foldString(s string) (string, []int) {
+	var sb strings.Builder
+	offsets := make([]int, 0, len(s)+1)
+
+	for idx, r := range s {
+		folded := foldRune(r)
+		sb.WriteString(folded)
+		for range len(folded) {
+			offsets = append(offsets, idx)
+		}
+	}
+	offsets = append(offsets, len(s))
+
+	return sb.String(), offsets
+}
+
+// Compiles the watchlist entries.
+// Invalid regular expressions are reported through the returned error,
+// and skipped so that the rest of the watchlist keeps working.
+func CompileWatchlist(entries []WatchlistEntry) (*Watchlist, error) {
+	w := &Watchlist{}
+	var errs []error
+
+	for _, entry := range entries {
+		if entry.Pattern == "" {
+			continue
+		}
+
+		var expr string
+		if entry.Regex {
+			// Patterns are matched against folded text, so fold their literal characters too.
+			expr = foldPattern(entry.Pattern)
+		} else {
+			folded, _ := foldString(entry.Pattern)
+			expr = regexp.QuoteMeta(folded)
+		}
+
+		if entry.WholeWord {
+			expr = wordBoundaryStart + expr + wordBoundaryEnd
+		} else {
+			expr = "(" + expr + ")"
+		}
+
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		w.matchers = append(w.matchers, watchlistMatcher{entry: entry, re: re})
+	}
+
+	if len(errs) > 0 {
+		return w, errs[0]
+	}
+	return w, nil
+}
+
+// Folds the literal characters of a regular expression, leaving escapes and classes untouched.
+func foldPattern(pattern string) string {
+	var sb strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		if escaped || r == '\\' {
+			escaped = !escaped && r == '\\'
+			sb.WriteRune(r)
+			continue
+		}
+		if r < utf8.RuneSelf {
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteString(foldRune(r))
+	}
+	return sb.String()
+}
+
+func (w *Watchlist) Empty() bool {
+	return w == nil || len(w.matchers) == 0
+}
+
+// Returns the first watchlist entry matching the text.
+func (w *Watchlist) Match(text string) (WatchlistMatch, bool) {
+	if w.Empty() {
+		return WatchlistMatch{}, false
+	}
+
+	folded, offsets := foldString(text)
+	for _, m := range w.matchers {
+		loc := m.re.FindStringSubmatchIndex(folded)
+		if loc == nil {
+			continue
+		}
+
+		// Group 1 holds the term itself, without the word boundaries.
+		start, end := offsets[loc[2]], offsets[loc[3]]
+		return WatchlistMatch{
+			Entry: m.entry,
+			Text:  text[start:end],
+			Start: start,
+			End:   end,
+		}, true
+	}
+
+	return WatchlistMatch{}, false
+}
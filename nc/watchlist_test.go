@@ -0,0 +1,69 @@
+package nc
+
+import (
+	"testing"
+)
+
+func TestWatchlistMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry WatchlistEntry
+		text  string
+		match string // Expected matched text, empty for no match
+		start int
+	}{
+		{"case", WatchlistEntry{Pattern: "Release"}, "the RELEASE is out", "RELEASE", 4},
+		{"diacritics in the pattern", WatchlistEntry{Pattern: "Café"}, "meet at the cafe", "cafe", 12},
+		{"diacritics in the text", WatchlistEntry{Pattern: "cafe"}, "Le CAFÉ est fermé", "CAFÉ", 3},
+		{"decomposed text", WatchlistEntry{Pattern: "café", WholeWord: true}, "un cafe\u0301!", "cafe\u0301", 3},
+		{"offset after multibyte runes", WatchlistEntry{Pattern: "server"}, "Ärger mit dem Server", "Server", 15},
+		{"inside a longer word", WatchlistEntry{Pattern: "cat"}, "concatenate", "cat", 3},
+		{"whole word inside a longer word", WatchlistEntry{Pattern: "cat", WholeWord: true}, "concatenate", "", 0},
+		{"whole word before punctuation", WatchlistEntry{Pattern: "cat", WholeWord: true}, "the cat.", "cat", 4},
+		{"whole word before an accented letter", WatchlistEntry{Pattern: "cafe", WholeWord: true}, "cafés", "", 0},
+		{"non-Latin word", WatchlistEntry{Pattern: "Привет", WholeWord: true}, "привет всем", "привет", 0},
+		{"non-Latin inside a longer word", WatchlistEntry{Pattern: "привет", WholeWord: true}, "приветствие", "", 0},
+		{"non-Latin diacritics", WatchlistEntry{Pattern: "Ελλάδα"}, "στην ελλαδα", "ελλαδα", 9},
+		{"regex", WatchlistEntry{Pattern: `deploy(ed|ing)?`, Regex: true, WholeWord: true}, "Deployed today", "Deployed", 0},
+		{"regex with diacritics", WatchlistEntry{Pattern: `réunion \d+`, Regex: true}, "Reunion 12 demain", "Reunion 12", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := CompileWatchlist([]WatchlistEntry{tt.entry})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, ok := w.Match(tt.text)
+			if tt.match == "" {
+				if ok {
+					t.Errorf("matched %q, want no match", m.Text)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("no match, want %q", tt.match)
+			}
+			if m.Text != tt.match || m.Start != tt.start || m.End != tt.start+len(tt.match) {
+				t.Errorf("got %q at %d-%d, want %q at %d-%d", m.Text, m.Start, m.End, tt.match, tt.start, tt.start+len(tt.match))
+			}
+			if tt.text[m.Start:m.End] != m.Text {
+				t.Errorf("offsets %d-%d don't point to %q in the original text", m.Start, m.End, m.Text)
+			}
+		})
+	}
+}
+
+// An invalid regular expression is reported, and the other entries keep working.
+func TestWatchlistInvalidRegex(t *testing.T) {
+	w, err := CompileWatchlist([]WatchlistEntry{
+		{Pattern: "(", Regex: true},
+		{Pattern: "urgent"},
+	})
+	if err == nil {
+		t.Error("got no error for an invalid regular expression")
+	}
+	if m, ok := w.Match("Urgent: call me"); !ok || m.Entry.Pattern != "urgent" {
+		t.Errorf("got %+v, %v, want a match of the valid entry", m, ok)
+	}
+}
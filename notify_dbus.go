@@ -0,0 +1,188 @@
+//go:build !windows
+
+package main
+
+import (
+	"GoTalk/nc"
+	"html"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/browser"
+)
+
+const (
+	dbusNotificationsName      = "org.freedesktop.Notifications"
+	dbusNotificationsPath      = "/org/freedesktop/Notifications"
+	dbusNotificationsInterface = "org.freedesktop.Notifications"
+)
+
+type dbusNotifier struct {
+	mutex sync.Mutex
+	conn  *dbus.Conn
+	urls  map[uint32]string // URL to open when a notification is activated
+}
+
+var notifier dbusNotifier
+
+func (d *dbusNotifier) connect() (*dbus.Conn, error) {
+	if d.conn != nil && d.conn.Connected() {
+		return d.conn, nil
+	}
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(dbusNotificationsPath),
+		dbus.WithMatchInterface(dbusNotificationsInterface),
+	); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go d.handleSignals(signals)
+
+	d.conn = conn
+	d.urls = make(map[uint32]string)
+	return conn, nil
+}
+
+func (d *dbusNotifier) handleSignals(signals chan *dbus.Signal) {
+	for signal := range signals {
+		if len(signal.Body) < 1 {
+			continue
+		}
+		id, ok := signal.Body[0].(uint32)
+		if !ok {
+			continue
+		}
+
+		d.mutex.Lock()
+		url := d.urls[id]
+		switch signal.Name {
+		case dbusNotificationsInterface + ".ActionInvoked":
+			delete(d.urls, id)
+			// Buttons are keyed by their gotalk:// URI, "default" is a click on the notification.
+			// Only ours: the signal is broadcast for the notifications of every application.
+			if url != "" && len(signal.Body) > 1 {
+				if action, ok := signal.Body[1].(string); ok && action != "default" {
+					url = action
+				}
+			}
+		case dbusNotificationsInterface + ".NotificationClosed":
+			delete(d.urls, id)
+			url = ""
+		default:
+			url = ""
+		}
+		d.mutex.Unlock()
+
+		switch {
+		case isGoTalkURI(url):
+			// This process runs the monitors: no need to go through the URI scheme handler.
+			go func() {
+				if _, err := runURI(url); err != nil {
+					log.Print(err)
+				}
+			}()
+		case url != "":
+			browser.OpenURL(url)
+		}
+	}
+}
+
+func pushNotification(n nc.Notification, icon string, playAudio bool) (nc.NotificationHandle, error) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	conn, err := notifier.connect()
+	if err != nil {
+		return "", err
+	}
+
+	var replacesId uint64
+	if n.Replaces != "" {
+		replacesId, _ = strconv.ParseUint(string(n.Replaces), 10, 32)
+	}
+
+	var actions []string
+	if n.URL != "" {
+		actions = []string{"default", "Open"}
+	}
+	for _, action := range n.Actions {
+		actions = append(actions, action.URL, action.Label)
+	}
+
+	var urgency byte = 1
+	switch n.Urgency {
+	case nc.UrgencyLow:
+		urgency = 0
+	case nc.UrgencyCritical:
+		urgency = 2
+	}
+
+	hints := map[string]dbus.Variant{
+		"urgency":        dbus.MakeVariant(urgency),
+		"desktop-entry":  dbus.MakeVariant("gotalk"),
+		"suppress-sound": dbus.MakeVariant(!playAudio),
+	}
+	if n.Category != "" {
+		hints["category"] = dbus.MakeVariant(string(n.Category))
+	}
+	if playAudio {
+		hints["sound-name"] = dbus.MakeVariant("message-new-instant")
+	}
+
+	// There's no attribution line: the account goes at the end of the body.
+	body := html.EscapeString(n.Message)
+	if n.Account != "" {
+		body += "\n" + html.EscapeString(n.Account)
+	}
+
+	var id uint32
+	err = conn.Object(dbusNotificationsName, dbusNotificationsPath).Call(
+		dbusNotificationsInterface+".Notify", 0,
+		"GoTalk",
+		uint32(replacesId),
+		icon,
+		n.Title,
+		body,
+		actions,
+		hints,
+		int32(-1),
+	).Store(&id)
+	if err != nil {
+		return "", err
+	}
+
+	if n.URL != "" {
+		notifier.urls[id] = n.URL
+	}
+
+	return nc.NotificationHandle(strconv.FormatUint(uint64(id), 10)), nil
+}
+
+func withdrawNotification(handle nc.NotificationHandle) error {
+	id, err := strconv.ParseUint(string(handle), 10, 32)
+	if err != nil {
+		return err
+	}
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+
+	conn, err := notifier.connect()
+	if err != nil {
+		return err
+	}
+
+	delete(notifier.urls, uint32(id))
+	return conn.Object(dbusNotificationsName, dbusNotificationsPath).Call(dbusNotificationsInterface+".CloseNotification", 0, uint32(id)).Err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+)
+
+const toastAppID = "Nextcloud Talk"
+
+// Toast notifications are identified by a Tag and a Group, both limited to 64 characters.
+// The Group identifies the instance, while the Tag identifies the conversation.
+// Showing a toast with the same Tag and Group replaces the previous one in the action center.
+func toastTagGroup(n nc.Notification) (string, string) {
+	h := fnv.New32a()
+	h.Write([]byte(n.Instance))
+	group := fmt.Sprintf("gotalk-%08x", h.Sum32())
+
+	tag := n.ConversationToken
+	if tag == "" {
+		tag = string(n.Category)
+	}
+	if len(tag) > 64 {
+		tag = tag[:64]
+	}
+
+	return tag, group
+}
+
+func toastHandle(tag string, group string) nc.NotificationHandle {
+	return nc.NotificationHandle(group + "/" + tag)
+}
+
+func parseToastHandle(handle nc.NotificationHandle) (string, string, error) {
+	group, tag, ok := strings.Cut(string(handle), "/")
+	if !ok {
+		return "", "", errors.New("invalid toast handle")
+	}
+	return tag, group, nil
+}
+
+func xmlEscape(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+// Quotes a string for a single-quoted PowerShell literal.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func buildToastXML(n nc.Notification, icon string, playAudio bool) string {
+	var sb strings.Builder
+
+	sb.WriteString(`<toast activationType="protocol" launch="` + xmlEscape(n.URL) + `">`)
+	sb.WriteString(`<visual><binding template="ToastGeneric">`)
+	if icon != "" {
+		sb.WriteString(`<image placement="appLogoOverride" src="` + xmlEscape(icon) + `" />`)
+	}
+	if n.Title != "" {
+		sb.WriteString(`<text>` + xmlEscape(n.Title) + `</text>`)
+	}
+	if n.Message != "" {
+		sb.WriteString(`<text>` + xmlEscape(n.Message) + `</text>`)
+	}
+	if n.Account != "" {
+		sb.WriteString(`<text placement="attribution">` + xmlEscape(n.Account) + `</text>`)
+	}
+	sb.WriteString(`</binding></visual>`)
+
+	if playAudio {
+		sb.WriteString(`<audio src="ms-winsoundevent:Notification.IM" />`)
+	} else {
+		sb.WriteString(`<audio silent="true" />`)
+	}
+
+	if n.URL != "" || len(n.Actions) > 0 {
+		sb.WriteString(`<actions>`)
+		if n.URL != "" {
+			sb.WriteString(`<action activationType="protocol" content="Open" arguments="` + xmlEscape(n.URL) + `" />`)
+		}
+		// gotalk:// actions start GoTalk, which hands them to the running instance.
+		for _, action := range n.Actions {
+			sb.WriteString(`<action activationType="protocol" content="` + xmlEscape(action.Label) + `" arguments="` + xmlEscape(action.URL) + `" />`)
+		}
+		sb.WriteString(`</actions>`)
+	}
+	sb.WriteString(`</toast>`)
+
+	return sb.String()
+}
+
+func runPowerShell(script string) error {
+	// -EncodedCommand expects base64-encoded UTF-16LE.
+	encoded := utf16.Encode([]rune(script))
+	raw := make([]byte, len(encoded)*2)
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(raw[i*2:], c)
+	}
+
+	cmd := exec.Command("PowerShell", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-EncodedCommand", base64.StdEncoding.EncodeToString(raw))
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd.Run()
+}
+
+const toastScriptHeader = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+[Windows.UI.Notifications.ToastNotification, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+`
+
+func pushNotification(n nc.Notification, icon string, playAudio bool) (nc.NotificationHandle, error) {
+	tag, group := toastTagGroup(n)
+
+	var script strings.Builder
+	script.WriteString(toastScriptHeader)
+	script.WriteString("$xml = New-Object Windows.Data.Xml.Dom.XmlDocument\n")
+	script.WriteString("$xml.LoadXml(" + psQuote(buildToastXML(n, icon, playAudio)) + ")\n")
+	script.WriteString("$toast = New-Object Windows.UI.Notifications.ToastNotification $xml\n")
+	script.WriteString("$toast.Tag = " + psQuote(tag) + "\n")
+	script.WriteString("$toast.Group = " + psQuote(group) + "\n")
+	if n.Urgency == nc.UrgencyCritical {
+		script.WriteString("$toast.Priority = [Windows.UI.Notifications.ToastNotificationPriority]::High\n")
+	}
+	script.WriteString("[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(" + psQuote(toastAppID) + ").Show($toast)\n")
+
+	if err := runPowerShell(script.String()); err != nil {
+		return "", err
+	}
+
+	return toastHandle(tag, group), nil
+}
+
+func withdrawNotification(handle nc.NotificationHandle) error {
+	tag, group, err := parseToastHandle(handle)
+	if err != nil {
+		return err
+	}
+
+	return runPowerShell(toastScriptHeader +
+		"[Windows.UI.Notifications.ToastNotificationManager]::History.Remove(" + psQuote(tag) + ", " + psQuote(group) + ", " + psQuote(toastAppID) + ")\n")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"GoTalk/nc"
+)
+
+// Where notifications go.
+// The tray always uses the desktop notifications, the daemon follows UserSettings.Daemon.
+type notificationBackend interface {
+	push(n nc.Notification, icon string, playAudio bool) (nc.NotificationHandle, error)
+	withdraw(handle nc.NotificationHandle) error
+}
+
+var notifications notificationBackend = desktopNotifications{}
+
+// Toasts on Windows, the D-Bus notification service elsewhere.
+type desktopNotifications struct{}
+
+func (desktopNotifications) push(n nc.Notification, icon string, playAudio bool) (nc.NotificationHandle, error) {
+	return pushNotification(n, icon, playAudio)
+}
+
+func (desktopNotifications) withdraw(handle nc.NotificationHandle) error {
+	return withdrawNotification(handle)
+}
+
+// Writes notifications to the log, e.g. the journal of a systemd service.
+type logNotifications struct{}
+
+func (logNotifications) push(n nc.Notification, icon string, playAudio bool) (nc.NotificationHandle, error) {
+	log.Printf("[%s] %s: %s %s", n.Instance, n.Title, n.Message, n.URL)
+	return "", nil
+}
+
+func (logNotifications) withdraw(handle nc.NotificationHandle) error {
+	return nil
+}
+
+// Maximum time a notification command may run
+const notifyCommandTimeout = time.Second * 30
+
+// Runs a command for each notification, which gets it through GOTALK_* environment variables.
+type execNotifications struct {
+	command []string
+}
+
+func urgencyName(urgency nc.NotificationUrgency) string {
+	switch urgency {
+	case nc.UrgencyLow:
+		return "low"
+	case nc.UrgencyCritical:
+		return "critical"
+	}
+	return "normal"
+}
+
+func (e execNotifications) push(n nc.Notification, icon string, playAudio bool) (nc.NotificationHandle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOTALK_INSTANCE="+n.Instance,
+		"GOTALK_ACCOUNT="+n.Account,
+		"GOTALK_TITLE="+n.Title,
+		"GOTALK_MESSAGE="+n.Message,
+		"GOTALK_URL="+n.URL,
+		"GOTALK_CATEGORY="+string(n.Category),
+		"GOTALK_URGENCY="+urgencyName(n.Urgency),
+		"GOTALK_CONVERSATION="+n.ConversationToken,
+		"GOTALK_SENDER="+n.ActorDisplayName,
+		"GOTALK_ICON="+icon,
+		"GOTALK_ACTIONS="+formatActions(n.Actions),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.New("notification command failed: " + err.Error() + ": " + string(output))
+	}
+	// A command can't take its notification back.
+	return "", nil
+}
+
+// One action per line, its label and its URI separated by a tab.
+func formatActions(actions []nc.NotificationAction) string {
+	lines := make([]string, 0, len(actions))
+	for _, action := range actions {
+		lines = append(lines, action.Label+"\t"+action.URL)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (execNotifications) withdraw(handle nc.NotificationHandle) error {
+	return nil
+}
+
+// Picks the backend named in the daemon settings.
+func newNotificationBackend(settings DaemonSettings) (notificationBackend, error) {
+	switch settings.Notifications {
+	case "", "dbus":
+		return desktopNotifications{}, nil
+	case "log":
+		return logNotifications{}, nil
+	case "exec":
+		if len(settings.NotifyCommand) == 0 {
+			return nil, errors.New(`Notifications = "exec" needs a NotifyCommand`)
+		}
+		return execNotifications{command: settings.NotifyCommand}, nil
+	}
+	return nil, errors.New("unknown notification backend " + settings.Notifications)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"GoTalk/nc"
+	"time"
+)
+
+// Picks the interval between two message checks.
+// Checks run at the fast interval right after some activity or while a call is running,
+// then slow down step by step until they reach the idle interval.
+type pollScheduler struct {
+	fast    time.Duration // Interval right after some activity
+	idle    time.Duration // Interval once nothing happened for a while
+	decay   float64       // Growth of the interval after each quiet check
+	current time.Duration
+
+	lastActivity time.Time // Most recent activity seen so far
+}
+
+func newPollScheduler(fast time.Duration, idle time.Duration) pollScheduler {
+	if idle < fast {
+		idle = fast
+	}
+
+	return pollScheduler{
+		fast:    fast,
+		idle:    idle,
+		decay:   1.5,
+		current: fast,
+	}
+}
+
+// Returns the interval until the next check, given what the last one saw.
+func (s *pollScheduler) next(activity nc.Activity) time.Duration {
+	if activity.CallInProgress || activity.LastActivity.After(s.lastActivity) {
+		s.current = s.fast
+	} else {
+		s.current = min(time.Duration(float64(s.current)*s.decay), s.idle)
+	}
+
+	if activity.LastActivity.After(s.lastActivity) {
+		s.lastActivity = activity.LastActivity
+	}
+
+	return s.current
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+// logind emits PrepareForSleep(true) right before suspending, and PrepareForSleep(false) after resuming.
+func watchResumeEvents(closeChan chan interface{}, onResume func()) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+
+	if err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath("/org/freedesktop/login1"),
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"),
+	); err != nil {
+		conn.Close()
+		return err
+	}
+
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	go func() {
+		defer conn.Close()
+		for {
+			select {
+			case signal := <-signals:
+				if len(signal.Body) < 1 {
+					continue
+				}
+				if sleeping, ok := signal.Body[0].(bool); ok && !sleeping {
+					onResume()
+				}
+			case <-closeChan:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	deviceNotifyCallback  = 2
+	pbtAPMResumeSuspend   = 0x7
+	pbtAPMResumeAutomatic = 0x12
+)
+
+var (
+	modPowrProf                                  = windows.NewLazySystemDLL("powrprof.dll")
+	procPowerRegisterSuspendResumeNotification   = modPowrProf.NewProc("PowerRegisterSuspendResumeNotification")
+	procPowerUnregisterSuspendResumeNotification = modPowrProf.NewProc("PowerUnregisterSuspendResumeNotification")
+)
+
+type deviceNotifySubscribeParameters struct {
+	callback uintptr
+	context  uintptr
+}
+
+// The callback and its parameters must outlive the registration: keep them reachable.
+var resumeSubscription *deviceNotifySubscribeParameters
+
+func watchResumeEvents(closeChan chan interface{}, onResume func()) error {
+	if err := procPowerRegisterSuspendResumeNotification.Find(); err != nil {
+		return err
+	}
+
+	resumeSubscription = &deviceNotifySubscribeParameters{
+		callback: syscall.NewCallback(func(context uintptr, changeType uintptr, setting uintptr) uintptr {
+			if changeType == pbtAPMResumeAutomatic || changeType == pbtAPMResumeSuspend {
+				go onResume()
+			}
+			return 0
+		}),
+	}
+
+	var handle uintptr
+	ret, _, _ := procPowerRegisterSuspendResumeNotification.Call(deviceNotifyCallback, uintptr(unsafe.Pointer(resumeSubscription)), uintptr(unsafe.Pointer(&handle)))
+	if ret != 0 {
+		return syscall.Errno(ret)
+	}
+
+	go func() {
+		<-closeChan
+		procPowerUnregisterSuspendResumeNotification.Call(handle)
+	}()
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/skip2/go-qrcode"
+)
+
+// Size of the QR code, in pixels
+const qrLoginCodeSize = 320
+
+// Shows the login page as a QR code, so that the user can approve this device from their phone.
+// The window counts down until the login flow expires. Closing it calls cancel.
+func showQRLoginWindow(instanceName string, loginURL string, timeout time.Duration, cancel func()) (loginPrompt, error) {
+	png, err := qrcode.Encode(loginURL, qrcode.Medium, qrLoginCodeSize)
+	if err != nil {
+		return loginPrompt{}, err
+	}
+
+	code := canvas.NewImageFromResource(fyne.NewStaticResource("login.png", png))
+	code.FillMode = canvas.ImageFillOriginal
+	code.SetMinSize(fyne.NewSize(qrLoginCodeSize, qrLoginCodeSize))
+
+	hint := widget.NewLabel("Scan this code with a phone logged in to " + instanceName + ", then approve the login.")
+	hint.Wrapping = fyne.TextWrapWord
+	hint.Alignment = fyne.TextAlignCenter
+
+	link := widget.NewLabel(loginURL)
+	link.Wrapping = fyne.TextWrapBreak
+	link.Alignment = fyne.TextAlignCenter
+
+	countdown := widget.NewLabel("")
+	countdown.Alignment = fyne.TextAlignCenter
+
+	window := fyne.CurrentApp().NewWindow(instanceName + " - Log In")
+	done := make(chan struct{})
+
+	window.SetContent(container.NewVBox(
+		hint,
+		container.NewCenter(code),
+		link,
+		countdown,
+		widget.NewButton("Cancel", window.Close),
+	))
+	window.Resize(fyne.NewSize(qrLoginCodeSize+80, 0))
+	window.SetFixedSize(true)
+	window.CenterOnScreen()
+	window.SetOnClosed(func() {
+		close(done)
+		cancel()
+	})
+
+	deadline := time.Now().Add(timeout)
+	updateCountdown := func() {
+		remaining := max(time.Until(deadline), 0).Round(time.Second)
+		countdown.SetText(fmt.Sprintf("This code expires in %d:%02d", int(remaining.Minutes()), int(remaining.Seconds())%60))
+	}
+	updateCountdown()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				updateCountdown()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	window.Show()
+
+	return loginPrompt{
+		dismiss: func() {
+			select {
+			case <-done:
+			default:
+				window.Close()
+			}
+		},
+	}, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "GoTalk/nc"
+
+// Bump this whenever UserSettings needs a migration step.
+const currentUserSettingsVersion = 1
+
+// Brings settings written by older versions of GoTalk up to date.
+// Returns true if anything changed and the settings should be saved.
+func migrateUserSettings(u *UserSettings) bool {
+	if u.SettingsVersion >= currentUserSettingsVersion {
+		return false
+	}
+
+	if u.SettingsVersion < 1 {
+		// Version 1 added toggles for the remaining Talk room types.
+		// Missing keys are read back as false, so the ones that default to true need to be restored.
+		defaults := nc.DefaultNotificationSettings()
+		for name, data := range u.InstanceData {
+			data.NotificationSettings.ShowNoteToSelfNotifications = defaults.ShowNoteToSelfNotifications
+			data.NotificationSettings.ShowChangelogNotifications = defaults.ShowChangelogNotifications
+			data.NotificationSettings.ShowFileChatNotifications = defaults.ShowFileChatNotifications
+			data.NotificationSettings.ShowVideoVerificationNotifications = defaults.ShowVideoVerificationNotifications
+			data.NotificationSettings.ShowPhoneNotifications = defaults.ShowPhoneNotifications
+			u.InstanceData[name] = data
+		}
+	}
+
+	u.SettingsVersion = currentUserSettingsVersion
+	return true
+}
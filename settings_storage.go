@@ -1,6 +1,9 @@
 package main
 
-import "GoTalk/nc"
+import (
+	"GoTalk/nc"
+	"time"
+)
 
 type LoginType int64
 
@@ -13,11 +16,40 @@ const (
 
 	// Start the Login Flow with a right-click option
 	LoginWithContextMenu
+
+	// Show the login page as a QR code, to log in from a phone
+	LoginWithQRCode
+
+	// Show a window explaining which instance wants a login
+	LoginWithDialog
+
+	// Ask for a user name and an app password, without a browser
+	LoginWithAppPassword
+
+	// Log in through an OAuth2 client registered in the Nextcloud OAuth2 app
+	LoginWithOAuth2
+)
+
+type UserInstancePolicy int64
+
+const (
+	// Only the instances of the organization can be monitored
+	UserInstancesForbidden UserInstancePolicy = iota
+
+	// Users can add any instance from the tray
+	UserInstancesAllowed
+
+	// Users can add instances within UserInstanceDomains
+	UserInstancesAllowlist
 )
 
 type InstanceCache struct {
 	Username             string // Username for logging in to Nextcloud
-	EncryptedAppPassword string // AppPassword received through the Nextcloud Login Flow - Encrypted through DPAPI
+	EncryptedAppPassword string // AppPassword received through the Nextcloud Login Flow - Encrypted through DPAPI, or AES-GCM outside Windows
+
+	EncryptedAccessToken  string    // OAuth2 access token - Encrypted through DPAPI, or AES-GCM outside Windows
+	EncryptedRefreshToken string    // OAuth2 refresh token - Encrypted through DPAPI, or AES-GCM outside Windows
+	AccessTokenExpiry     time.Time // When the OAuth2 access token expires
 }
 
 type Cache struct {
@@ -26,13 +58,32 @@ type Cache struct {
 
 type UserInstanceSettings struct {
 	NotificationSettings nc.NotificationSettings
+	EffectiveInstanceURL string // New URL of the instance, accepted by the user after a domain move. Must be the InstanceURL host or an alias.
+
+	Accounts []string // Names of additional accounts monitored on this instance. Only read from the entry of the instance itself.
 }
 
 type UserSettings struct {
-	InstanceData map[string]UserInstanceSettings // Nextcloud instances that the user logged in to
+	SettingsVersion uint64                          // Schema version of this file, used to migrate older settings
+	InstanceData    map[string]UserInstanceSettings // Nextcloud accounts that the user logged in to. Additional accounts are keyed "Instance (Account)".
 
 	ShowNotifications      bool // Global toggle for preventing notifications
 	PlayNotificationSounds bool // Global toggle for muting audio
+
+	Watchlist []nc.WatchlistEntry // Keywords that trigger a notification even in muted or filtered conversations
+
+	UserInstances map[string]UserInstance // Instances added by the user from the tray, subject to OrgSettings.UserInstances
+
+	Daemon DaemonSettings // How "GoTalk daemon" runs, without the tray
+}
+
+type DaemonSettings struct {
+	Notifications string   // Where notifications go: "dbus" (default), "log" or "exec"
+	NotifyCommand []string // Command run by "exec" for each notification, which gets it through GOTALK_* environment variables
+}
+
+type UserInstance struct {
+	InstanceURL string // Base URL discovered when the instance was added
 }
 
 type OrgInstanceSettings struct {
@@ -40,12 +91,144 @@ type OrgInstanceSettings struct {
 	Login                  LoginType // Chooses how to handle the application startup when the user isn't logged in yet
 	NotificationRepeatTime float64   // After how many minutes should a notification for the same chat appear twice?
 	NotificationAppIcon    string    // Custom App Icon. Uses en embedded resource otherwise. Should be a full path pointing to a PNG file.
+	DigestThreshold        uint64    // Above this many conversations with new messages at once, send a single digest notification. 0 disables digests.
+
+	ConnectTimeout float64 // Seconds allowed to connect to the instance, TLS handshake included. 0 uses the default (10).
+	RequestTimeout float64 // Seconds allowed for a whole request. 0 uses the default (30).
+	RetryCount     int64   // How many times a failed read-only request is retried. 0 uses the default (2), -1 disables retries.
+	RetryDelay     float64 // Seconds to wait before the first retry, doubled on every attempt. 0 uses the default (1).
+
+	CACertificates    []string // PEM files with certificate authorities trusted in addition to the system ones
+	PinnedPublicKeys  []string // Base64 SHA-256 hashes of the server public key (SPKI). When set, the server must present one of them.
+	ClientCertificate string   // PEM client certificate for mutual TLS
+	ClientKey         string   // PEM private key of the client certificate
+	MinTLSVersion     string   // Minimum TLS version: "1.2" (default) or "1.3". "1.0" and "1.1" are accepted for legacy servers.
+	ProxyURL          string   // Explicit proxy: http://, https:// or socks5:// URL. Uses the system environment otherwise.
+	ProxyPAC          string   // URL or full path of a proxy auto-config (PAC) file. Ignored when ProxyURL is set.
+
+	InstanceAliases []string // Other host names or URLs of this instance, that a login may be redirected to
+
+	LoginTimeout      float64 // Minutes the user has to complete a login flow. 0 uses the default (20).
+	LoginPollInterval float64 // Seconds between two checks of a pending login flow. 0 uses the default (5).
 
-	setInstanceLoginMenuOption func(callback func())
+	OAuth2ClientID     string // Client identifier of the OAuth2 client, for LoginWithOAuth2
+	OAuth2ClientSecret string // Secret of the OAuth2 client
+	OAuth2RedirectPort int64  // Port of the registered http://127.0.0.1:PORT/ redirect URI. 0 picks a free port.
+
+	PrefillUsername bool // Pre-fills the user name of the app password login with the OS account name
+
+	LoginReminders     int64   // How many times an unanswered login prompt comes back. 0 uses the default (3), negative never.
+	LoginReminderDelay float64 // Minutes before the first reminder, doubled for each following one. 0 uses the default (30).
+
+	MinCheckInterval float64 // Seconds between checks right after some activity or during a call. 0 uses MessageCheckTime.
+	MaxCheckInterval float64 // Seconds between checks once the instance is idle. 0 uses the default (60).
+
+	BackoffInitial    float64 // Seconds to wait after the first failed check. 0 uses the default (10).
+	BackoffMax        float64 // Maximum seconds to wait between failed checks. 0 uses the default (600).
+	BackoffMultiplier float64 // Growth of the wait after each consecutive failure. 0 uses the default (2).
+	BackoffJitter     float64 // Random spread applied to each wait, below 1. 0 uses the default (0.2), negative none.
+}
+
+func (o OrgInstanceSettings) httpSettings() nc.HTTPSettings {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+
+	return nc.HTTPSettings{
+		DialTimeout:         seconds(o.ConnectTimeout),
+		TLSHandshakeTimeout: seconds(o.ConnectTimeout),
+		RequestTimeout:      seconds(o.RequestTimeout),
+		MaxRetries:          int(o.RetryCount),
+		RetryDelay:          seconds(o.RetryDelay),
+		TLS: nc.TLSSettings{
+			CAFiles:        o.CACertificates,
+			PinnedSPKI:     o.PinnedPublicKeys,
+			ClientCertFile: o.ClientCertificate,
+			ClientKeyFile:  o.ClientKey,
+			MinVersion:     o.MinTLSVersion,
+		},
+		Proxy: nc.ProxySettings{
+			URL: o.ProxyURL,
+			PAC: o.ProxyPAC,
+		},
+	}
+}
+
+func (o OrgInstanceSettings) loginFlowTimeout() time.Duration {
+	if o.LoginTimeout <= 0 {
+		return nc.DefaultLoginFlowTimeout
+	}
+	return time.Duration(o.LoginTimeout * float64(time.Minute))
+}
+
+func (o OrgInstanceSettings) loginFlowPollInterval() time.Duration {
+	if o.LoginPollInterval <= 0 {
+		return nc.DefaultLoginFlowPollInterval
+	}
+	return time.Duration(o.LoginPollInterval * float64(time.Second))
+}
+
+func (o OrgInstanceSettings) oauth2Config() nc.OAuth2Config {
+	return nc.OAuth2Config{
+		ClientID:     o.OAuth2ClientID,
+		ClientSecret: o.OAuth2ClientSecret,
+		RedirectPort: int(o.OAuth2RedirectPort),
+	}
+}
+
+// How many times an unanswered login prompt comes back, and after how long.
+func (o OrgInstanceSettings) loginReminderPolicy() (int, time.Duration) {
+	reminders := int(o.LoginReminders)
+	if reminders == 0 {
+		reminders = 3
+	} else if reminders < 0 {
+		reminders = 0
+	}
+
+	delay := time.Duration(o.LoginReminderDelay * float64(time.Minute))
+	if delay <= 0 {
+		delay = time.Minute * 30
+	}
+	return reminders, delay
+}
+
+// Minimum bound for any check interval, in seconds
+const minCheckInterval = 2
+
+func (o OrgInstanceSettings) pollScheduler(messageCheckTime uint64) pollScheduler {
+	fast := o.MinCheckInterval
+	if fast <= 0 {
+		fast = max(float64(messageCheckTime), 5)
+	}
+	idle := o.MaxCheckInterval
+	if idle <= 0 {
+		idle = 60
+	}
+
+	return newPollScheduler(
+		time.Duration(max(fast, minCheckInterval)*float64(time.Second)),
+		time.Duration(max(idle, minCheckInterval)*float64(time.Second)),
+	)
+}
+
+func (o OrgInstanceSettings) backoffPolicy() backoffPolicy {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+
+	return backoffPolicy{
+		initial:    seconds(o.BackoffInitial),
+		max:        seconds(o.BackoffMax),
+		multiplier: o.BackoffMultiplier,
+		jitter:     o.BackoffJitter,
+	}.withDefaults()
 }
 
 type OrgSettings struct {
 	InstanceData      map[string]OrgInstanceSettings // Nextcloud instances that the user will be prompted to login for
 	MessageCheckTime  uint64                         // Time in seconds between each message notification check
 	SystemTrayAppIcon string                         // Custom App Icon. Uses an embedded resource otherwise. Should be a full path pointing to a ICO file.
+
+	UserInstances       UserInstancePolicy // Whether users can add their own instances from the tray
+	UserInstanceDomains []string           // Domains allowed by UserInstancesAllowlist, subdomains included
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"GoTalk/nc"
+
+	"github.com/pkg/browser"
+)
+
+// Only one GoTalk process per user runs the monitors: two would both notify, and both rewrite the settings.
+// It holds a lock file in the cache directory, and listens on a socket next to it
+// for the commands that later invocations forward to it.
+// Windows 10 and later support Unix sockets as well.
+var (
+	errAlreadyRunning = errors.New("GoTalk is already running")
+	errNotRunning     = errors.New("GoTalk isn't running")
+)
+
+const (
+	forwardDialTimeout  = time.Second * 5  // How long a second invocation waits for the running one to listen
+	forwardReplyTimeout = time.Minute * 2  // How long a forwarded command may take
+	forwardMaxRequest   = 64 * 1024        // Largest forwarded request, in bytes
+	forwardLoginTimeout = time.Second * 90 // How long a forwarded login may take to start
+	forwardQueryTimeout = time.Minute      // How long a monitor may take to answer a forwarded request
+)
+
+// Commands that later invocations forward to the running process
+type forwardRequest struct {
+	Args []string
+}
+
+type forwardReply struct {
+	Output string
+	Error  string
+}
+
+// The lock held by the process running the monitors.
+type instanceLock struct {
+	file     *os.File
+	listener net.Listener
+}
+
+func instancePaths() (lockPath string, socketPath string, err error) {
+	dir, err := settingsManager.CacheDir()
+	if err != nil {
+		return "", "", err
+	}
+	return dir + string(os.PathSeparator) + "GoTalk.lock", dir + string(os.PathSeparator) + "GoTalk.sock", nil
+}
+
+// Makes this process the one running the monitors, and serves the commands forwarded to it.
+// Returns errAlreadyRunning when another process holds the lock.
+func acquireInstanceLock() (*instanceLock, error) {
+	lockPath, socketPath, err := instancePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if isLockHeld(err) {
+			return nil, errAlreadyRunning
+		}
+		// E.g. a file system without locks: forwarding to a socket nobody serves would be worse.
+		return nil, errors.New("locking " + lockPath + ": " + err.Error())
+	}
+
+	// Left behind by a process that didn't exit cleanly: nobody else can be listening, since we hold the lock.
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Forwarded commands log in and out: only the user may send them.
+	if err := restrictSocket(socketPath); err != nil {
+		listener.Close()
+		file.Close()
+		return nil, err
+	}
+
+	go serveForwardedCommands(listener)
+	return &instanceLock{file: file, listener: listener}, nil
+}
+
+func (l *instanceLock) release() {
+	if l == nil {
+		return
+	}
+	l.listener.Close()
+	l.file.Close()
+}
+
+func serveForwardedCommands(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Print(err)
+			}
+			return
+		}
+		go handleForwardedConn(conn)
+	}
+}
+
+func handleForwardedConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardReplyTimeout))
+
+	var request forwardRequest
+	if err := json.NewDecoder(io.LimitReader(conn, forwardMaxRequest)).Decode(&request); err != nil {
+		log.Print(err)
+		return
+	}
+
+	var reply forwardReply
+	output, err := runForwardedCommand(request.Args)
+	reply.Output = output
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		log.Print(err)
+	}
+}
+
+// Whether another process holds the instance lock, and so listens or is about to.
+func instanceLockHeld(lockPath string) bool {
+	file, err := os.OpenFile(lockPath, os.O_RDWR, 0)
+	if err != nil {
+		// No lock file: GoTalk never ran the monitors.
+		return false
+	}
+	// Closing the file releases the lock, if this takes it.
+	defer file.Close()
+	return isLockHeld(lockFile(file))
+}
+
+// Sends a command to the process running the monitors, and returns its answer.
+// Returns errNotRunning when no process listens.
+func forwardCommand(args []string) (string, error) {
+	lockPath, socketPath, err := instancePaths()
+	if err != nil {
+		return "", err
+	}
+
+	// The running process may have just taken the lock: give it a moment to listen.
+	// Without anyone holding the lock, a leftover socket is stale and nobody is about to listen.
+	var conn net.Conn
+	deadline := time.Now().Add(forwardDialTimeout)
+	for {
+		conn, err = net.Dial("unix", socketPath)
+		if err == nil {
+			break
+		}
+		if !instanceLockHeld(lockPath) || time.Now().After(deadline) {
+			return "", fmt.Errorf("%w: %v", errNotRunning, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardReplyTimeout))
+
+	if err := json.NewEncoder(conn).Encode(forwardRequest{Args: args}); err != nil {
+		return "", err
+	}
+	var reply forwardReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return "", err
+	}
+	if reply.Error != "" {
+		return reply.Output, errors.New(reply.Error)
+	}
+	return reply.Output, nil
+}
+
+// Whether a command line argument is a URL rather than a command, e.g. the activation of a notification.
+func isActivationURL(arg string) bool {
+	return strings.Contains(arg, "://")
+}
+
+func forwardedLoginMessage(ref accountRef, loginURL string) string {
+	return "Open this URL in a browser to log in to " + ref.key() + ":\n" + loginURL + "\nThe running GoTalk finishes the login."
+}
+
+// Runs a command forwarded by another invocation, in the process running the monitors.
+func runForwardedCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return "GoTalk is already running.", nil
+	}
+	if isActivationURL(args[0]) {
+		args = slices.Insert(args, 0, "open")
+	}
+	switch args[0] {
+	case "status":
+		return runningStatus(args[1:])
+	case "rooms":
+		return runningRooms(args[1:])
+	}
+	if len(args) != 2 {
+		return "", fmt.Errorf("%s: expected 1 argument, got %d", args[0], len(args)-1)
+	}
+
+	switch args[0] {
+	case "open":
+		return openTarget(args[1])
+	case "login":
+		ref, err := findAccount(args[1])
+		if err != nil {
+			return "", err
+		}
+		urls := make(chan string, 1)
+		if err := loginMonitor(ref.key(), forwardedLogin{urls: urls}); err != nil {
+			// Login modes like the notification start the flow on their own: hand out its page.
+			if loginURL, ok := pendingLoginURL(ref.key()); ok {
+				return forwardedLoginMessage(ref, loginURL), nil
+			}
+			return "", err
+		}
+		select {
+		case loginURL := <-urls:
+			return forwardedLoginMessage(ref, loginURL), nil
+		case <-time.After(forwardLoginTimeout):
+			return "", errors.New("the login of " + ref.key() + " didn't start, see the log of the running GoTalk")
+		}
+	case "logout":
+		ref, err := findAccount(args[1])
+		if err != nil {
+			return "", err
+		}
+		logoutMonitor(ref.key())
+		return "Logging out of " + ref.key() + ".", nil
+	}
+	return "", errors.New("unknown command " + args[0])
+}
+
+// Opens an instance, or a URL belonging to one, in the browser. gotalk:// URIs run their action.
+func openTarget(target string) (string, error) {
+	if isGoTalkURI(target) {
+		return runURI(target)
+	}
+	if !isActivationURL(target) {
+		ref, err := findAccount(target)
+		if err != nil {
+			return "", err
+		}
+		target = instanceURL(ref.instance)
+	} else {
+		trusted, err := trustedInstanceURL(target)
+		if err != nil {
+			return "", err
+		}
+		target = trusted
+	}
+
+	if err := browser.OpenURL(target); err != nil {
+		return "", err
+	}
+	return "Opened " + target + ".", nil
+}
+
+// Checks that a URL belongs to a configured instance, so that other programs can't use GoTalk to open anything.
+func trustedInstanceURL(raw string) (string, error) {
+	for _, ref := range configuredAccounts() {
+		if ref.account != "" {
+			continue
+		}
+		settings, _ := instanceSettings(ref.instance)
+		instance := nc.NewInstance(ref.instance, instanceURL(ref.instance))
+		instance.SetTrustedAliases(settings.InstanceAliases)
+		if trusted, err := instance.CheckTrustedURL(raw); err == nil {
+			return trusted, nil
+		}
+	}
+	return "", errors.New(raw + " doesn't belong to a configured instance")
+}
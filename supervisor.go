@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shutdownTimeout = time.Second * 10 // How long quitting waits for the monitors to stop
+	crashResetAfter = time.Minute * 30 // A monitor running this long forgets its earlier crashes
+)
+
+// Runs the monitor of an account, and restarts it after a panic, waiting longer after each crash.
+// Returns once closeChan is closed.
+func superviseMonitor(ref accountRef, menu *accountMenu, wg *sync.WaitGroup, closeChan chan interface{}) {
+	defer wg.Done()
+
+	backoff := defaultBackoffPolicy()
+	crashes := 0
+	for {
+		started := time.Now()
+		if !runMonitor(newMonitorProc(ref, menu), closeChan) {
+			return
+		}
+
+		if time.Since(started) > crashResetAfter {
+			crashes = 0
+		}
+		crashes++
+
+		delay := backoff.delay(crashes, nil)
+		menu.setStatus(fmt.Sprintf("Monitor crashed, restarting in %s", delay.Round(time.Second)))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-closeChan:
+			timer.Stop()
+			return
+		}
+
+		// Removed from the tray in the meantime
+		if !slices.Contains(configuredAccounts(), ref) {
+			return
+		}
+	}
+}
+
+// Runs a monitor until closeChan is closed. Returns true if it panicked instead.
+func runMonitor(p *monitorProcData, closeChan chan interface{}) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s: monitor crashed: %v\n%s", p.accountKey, r, debug.Stack())
+			crashed = true
+		}
+	}()
+
+	p.run(closeChan)
+	return false
+}
+
+// Waits for the monitors to stop, for up to the given time.
+// Returns false, after logging the accounts still running, if they didn't stop in time.
+func waitForMonitors(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	}
+
+	monitorsMutex.Lock()
+	running := make([]string, 0, len(monitors))
+	for key := range monitors {
+		running = append(running, key)
+	}
+	monitorsMutex.Unlock()
+
+	sort.Strings(running)
+	log.Printf("monitors still running after %s: %s", timeout, strings.Join(running, ", "))
+	return false
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"log"
+	"slices"
+
+	"github.com/pkg/browser"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Tray submenu of one account.
+// Its methods are called by the monitor of the account, and do nothing on a nil menu.
+type accountMenu struct {
+	menu    *fyne.Menu     // Tray menu that holds the submenu
+	submenu *fyne.MenuItem // Submenu labelled with the account
+
+	coreItems     []*fyne.MenuItem
+	statusItem    *fyne.MenuItem
+	switchURLItem *fyne.MenuItem
+	loginItem     *fyne.MenuItem
+	logoutItem    *fyne.MenuItem
+}
+
+// Builds the tray submenu of an account.
+// The submenu of a primary account also offers to add an account, which calls onAdd once saved.
+// The submenu of an additional account offers to remove it, which calls onRemove once its monitor stops.
+func newAccountMenu(ref accountRef, menu *fyne.Menu, onAdd func(accountRef), onRemove func(*accountMenu)) *accountMenu {
+	key := ref.key()
+	var m *accountMenu
+
+	var openInstance *fyne.MenuItem
+	var showUserNotifications *fyne.MenuItem
+	var showGroupNotifications *fyne.MenuItem
+	var showBotNotifications *fyne.MenuItem
+	var showGuestNotifications *fyne.MenuItem
+	var showBridgedNotifications *fyne.MenuItem
+	var showNoteToSelfNotifications *fyne.MenuItem
+	var showChangelogNotifications *fyne.MenuItem
+	var showFileChatNotifications *fyne.MenuItem
+	var showVideoVerificationNotifications *fyne.MenuItem
+	var showPhoneNotifications *fyne.MenuItem
+	var showMutedNotifications *fyne.MenuItem
+	var playNotificationSounds *fyne.MenuItem
+
+	updateSettings := func() {
+		settingsMutex.Lock()
+		defer settingsMutex.Unlock()
+
+		data := user.InstanceData[key]
+		data.NotificationSettings.ShowUserNotifications = showUserNotifications.Checked
+		data.NotificationSettings.ShowGroupNotifications = showGroupNotifications.Checked
+		data.NotificationSettings.ShowBotNotifications = showBotNotifications.Checked
+		data.NotificationSettings.ShowGuestNotifications = showGuestNotifications.Checked
+		data.NotificationSettings.ShowBridgedNotifications = showBridgedNotifications.Checked
+		data.NotificationSettings.ShowNoteToSelfNotifications = showNoteToSelfNotifications.Checked
+		data.NotificationSettings.ShowChangelogNotifications = showChangelogNotifications.Checked
+		data.NotificationSettings.ShowFileChatNotifications = showFileChatNotifications.Checked
+		data.NotificationSettings.ShowVideoVerificationNotifications = showVideoVerificationNotifications.Checked
+		data.NotificationSettings.ShowPhoneNotifications = showPhoneNotifications.Checked
+		data.NotificationSettings.ShowMutedNotifications = showMutedNotifications.Checked
+		data.NotificationSettings.PlayNotificationSounds = playNotificationSounds.Checked
+		user.InstanceData[key] = data
+
+		settingsManager.Save(cache, user, org)
+	}
+
+	openInstance = fyne.NewMenuItem("Open", func() {
+		browser.OpenURL(instanceURL(ref.instance))
+	})
+	retryNow := fyne.NewMenuItem("Retry Now", func() {
+		retryMonitor(key)
+	})
+	diagnostics := fyne.NewMenuItem("Diagnostics", func() {
+		showMonitorDiagnostics(key)
+	})
+	showUserNotifications = fyne.NewMenuItem("Show User Notifications", func() {
+		showUserNotifications.Checked = !showUserNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showGroupNotifications = fyne.NewMenuItem("Show Group Notifications", func() {
+		showGroupNotifications.Checked = !showGroupNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showBotNotifications = fyne.NewMenuItem("Show Bot Notifications", func() {
+		showBotNotifications.Checked = !showBotNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showGuestNotifications = fyne.NewMenuItem("Show Guest Notifications", func() {
+		showGuestNotifications.Checked = !showGuestNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showBridgedNotifications = fyne.NewMenuItem("Show Bridged Notifications", func() {
+		showBridgedNotifications.Checked = !showBridgedNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showNoteToSelfNotifications = fyne.NewMenuItem("Show Note to Self Notifications", func() {
+		showNoteToSelfNotifications.Checked = !showNoteToSelfNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showChangelogNotifications = fyne.NewMenuItem("Show Changelog Notifications", func() {
+		showChangelogNotifications.Checked = !showChangelogNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showFileChatNotifications = fyne.NewMenuItem("Show File Chat Notifications", func() {
+		showFileChatNotifications.Checked = !showFileChatNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showVideoVerificationNotifications = fyne.NewMenuItem("Show Video Verification Notifications", func() {
+		showVideoVerificationNotifications.Checked = !showVideoVerificationNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showPhoneNotifications = fyne.NewMenuItem("Show Phone Notifications", func() {
+		showPhoneNotifications.Checked = !showPhoneNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	showMutedNotifications = fyne.NewMenuItem("Show Muted Notifications", func() {
+		showMutedNotifications.Checked = !showMutedNotifications.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+	playNotificationSounds = fyne.NewMenuItem("Play Notification Sounds", func() {
+		playNotificationSounds.Checked = !playNotificationSounds.Checked
+		updateSettings()
+		menu.Refresh()
+	})
+
+	settingsMutex.Lock()
+	data := user.InstanceData[key]
+	settingsMutex.Unlock()
+	showUserNotifications.Checked = data.NotificationSettings.ShowUserNotifications
+	showGroupNotifications.Checked = data.NotificationSettings.ShowGroupNotifications
+	showBotNotifications.Checked = data.NotificationSettings.ShowBotNotifications
+	showGuestNotifications.Checked = data.NotificationSettings.ShowGuestNotifications
+	showBridgedNotifications.Checked = data.NotificationSettings.ShowBridgedNotifications
+	showNoteToSelfNotifications.Checked = data.NotificationSettings.ShowNoteToSelfNotifications
+	showChangelogNotifications.Checked = data.NotificationSettings.ShowChangelogNotifications
+	showFileChatNotifications.Checked = data.NotificationSettings.ShowFileChatNotifications
+	showVideoVerificationNotifications.Checked = data.NotificationSettings.ShowVideoVerificationNotifications
+	showPhoneNotifications.Checked = data.NotificationSettings.ShowPhoneNotifications
+	showMutedNotifications.Checked = data.NotificationSettings.ShowMutedNotifications
+	playNotificationSounds.Checked = data.NotificationSettings.PlayNotificationSounds
+
+	coreItems := []*fyne.MenuItem{
+		openInstance,
+		retryNow,
+		diagnostics,
+	}
+	if ref.account == "" && onAdd != nil {
+		coreItems = append(coreItems, fyne.NewMenuItem("Add Account...", func() {
+			showAddAccountWindow(ref.instance, onAdd)
+		}))
+	}
+	if ref.account != "" && onRemove != nil {
+		coreItems = append(coreItems, fyne.NewMenuItem("Remove Account...", func() {
+			showRemoveAccountWindow(ref, func() {
+				if err := removeMonitor(ref); err != nil {
+					log.Print(err)
+				}
+				onRemove(m)
+			})
+		}))
+	}
+	coreItems = append(coreItems,
+		fyne.NewMenuItemSeparator(),
+		showUserNotifications,
+		showGroupNotifications,
+		showBotNotifications,
+		showGuestNotifications,
+		showBridgedNotifications,
+		fyne.NewMenuItemSeparator(),
+		showNoteToSelfNotifications,
+		showChangelogNotifications,
+		showFileChatNotifications,
+		showVideoVerificationNotifications,
+		showPhoneNotifications,
+		fyne.NewMenuItemSeparator(),
+		showMutedNotifications,
+		playNotificationSounds,
+	)
+
+	m = &accountMenu{
+		menu:          menu,
+		submenu:       fyne.NewMenuItem(key, func() {}),
+		coreItems:     coreItems,
+		statusItem:    fyne.NewMenuItem("", nil),
+		switchURLItem: fyne.NewMenuItem("", nil),
+		loginItem:     fyne.NewMenuItem("Log In", func() {}),
+		logoutItem: fyne.NewMenuItem("Log Out", func() {
+			logoutMonitor(key)
+		}),
+	}
+	m.statusItem.Disabled = true
+	m.submenu.ChildMenu = fyne.NewMenu(key)
+	m.rebuildItems()
+
+	return m
+}
+
+// The status line goes on top, the login or logout option at the bottom.
+func (m *accountMenu) rebuildItems() {
+	items := make([]*fyne.MenuItem, 0, len(m.coreItems)+4)
+	if m.statusItem.Label != "" {
+		items = append(items, m.statusItem, fyne.NewMenuItemSeparator())
+	}
+	items = append(items, m.coreItems...)
+	if m.switchURLItem.Action != nil {
+		items = append(items, m.switchURLItem)
+	}
+	if m.loginItem.Action != nil {
+		items = append(items, m.loginItem)
+	} else {
+		items = append(items, m.logoutItem)
+	}
+	m.submenu.ChildMenu.Items = items
+	m.menu.Refresh()
+}
+
+// Shows the "Log In" option, or hides it with a nil callback.
+func (m *accountMenu) setLoginOption(callback func()) {
+	if m == nil {
+		return
+	}
+	m.loginItem.Action = callback
+	m.rebuildItems()
+}
+
+// Offers to switch to a new URL of the instance, or hides the offer with a nil callback.
+func (m *accountMenu) setURLOffer(url string, accept func()) {
+	if m == nil {
+		return
+	}
+	m.switchURLItem.Label = "Switch to " + url
+	m.switchURLItem.Action = accept
+	m.rebuildItems()
+}
+
+// Shows a status line on top of the submenu, or hides it when empty.
+func (m *accountMenu) setStatus(status string) {
+	if m == nil || m.statusItem.Label == status {
+		return
+	}
+	m.statusItem.Label = status
+	m.rebuildItems()
+}
+
+// Inserts the submenu of an account added at runtime in the tray menu.
+func (m *accountMenu) insertAt(idx int) {
+	m.menu.Items = slices.Insert(m.menu.Items, idx, m.submenu)
+	m.menu.Refresh()
+}
+
+// Takes the submenu of a removed account out of the tray menu.
+func (m *accountMenu) remove() {
+	m.menu.Items = slices.DeleteFunc(m.menu.Items, func(item *fyne.MenuItem) bool { return item == m.submenu })
+	m.menu.Refresh()
+}
+
+// Asks before removing an additional account: it's logged out, and its settings are lost.
+func showRemoveAccountWindow(ref accountRef, onConfirm func()) {
+	window := fyne.CurrentApp().NewWindow(ref.key() + " - Remove Account")
+
+	hint := widget.NewLabel("GoTalk logs out of " + ref.key() + " and forgets its notification settings. " +
+		"The account itself stays on the server.")
+	hint.Wrapping = fyne.TextWrapWord
+
+	remove := widget.NewButton("Remove", func() {
+		window.Close()
+		onConfirm()
+	})
+	remove.Importance = widget.DangerImportance
+
+	window.SetContent(container.NewVBox(hint, container.NewHBox(layout.NewSpacer(), widget.NewButton("Cancel", window.Close), remove)))
+	window.Resize(fyne.NewSize(420, 0))
+	window.CenterOnScreen()
+	window.Show()
+}
+
+// Asks for the name of an account to add to an instance.
+func showAddAccountWindow(instance string, onAdd func(accountRef)) {
+	window := fyne.CurrentApp().NewWindow(instance + " - Add Account")
+
+	name := widget.NewEntry()
+	name.SetPlaceHolder("helpdesk")
+
+	hint := widget.NewLabel("Each account gets its own menu and notification settings. Log in with the other account once it's added.")
+	hint.Wrapping = fyne.TextWrapWord
+
+	status := widget.NewLabel("")
+	status.Wrapping = fyne.TextWrapWord
+
+	form := &widget.Form{
+		Items: []*widget.FormItem{
+			widget.NewFormItem("Account name", name),
+		},
+		SubmitText: "Add",
+		CancelText: "Cancel",
+		OnCancel:   window.Close,
+		OnSubmit: func() {
+			ref, err := addAccount(instance, name.Text)
+			if err != nil {
+				status.SetText(err.Error())
+				return
+			}
+			window.Close()
+			onAdd(ref)
+		},
+	}
+
+	window.SetContent(container.NewVBox(hint, form, status))
+	window.Resize(fyne.NewSize(420, 0))
+	window.CenterOnScreen()
+	window.Show()
+}
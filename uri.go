@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/browser"
+)
+
+// Notification actions come back to GoTalk as gotalk:// URIs, launched by the notification service:
+//
+//	gotalk://open/<account>/<token>    Opens the conversation in the browser
+//	gotalk://read/<account>/<token>    Marks the conversation as read
+//	gotalk://snooze/<account>/<token>  Holds back the notifications of the conversation, for ?minutes= or an hour
+//	gotalk://login/<account>           Starts the login the account waits for
+//
+// The account is named like in the tray menu, path-escaped.
+const uriScheme = "gotalk"
+
+const (
+	uriOpen   = "open"
+	uriRead   = "read"
+	uriSnooze = "snooze"
+	uriLogin  = "login"
+)
+
+// How long "snooze" holds back notifications without a minutes parameter
+const defaultSnooze = time.Hour
+
+// An action on a conversation, run by the monitor of its account.
+type conversationAction struct {
+	verb   string // uriRead or uriSnooze
+	token  string
+	snooze time.Duration // How long uriSnooze lasts
+}
+
+// A parsed gotalk:// URI.
+type uriRequest struct {
+	conversationAction
+	account string
+}
+
+func actionURI(verb string, account string, token string) string {
+	uri := uriScheme + "://" + verb + "/" + url.PathEscape(account)
+	if token != "" {
+		uri += "/" + url.PathEscape(token)
+	}
+	return uri
+}
+
+func isGoTalkURI(raw string) bool {
+	return strings.HasPrefix(strings.ToLower(raw), uriScheme+"://")
+}
+
+func parseURI(raw string) (uriRequest, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return uriRequest{}, err
+	}
+	if !strings.EqualFold(u.Scheme, uriScheme) {
+		return uriRequest{}, errors.New(raw + " isn't a " + uriScheme + ":// URI")
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return uriRequest{}, err
+		}
+		segments = append(segments, unescaped)
+	}
+
+	request := uriRequest{conversationAction: conversationAction{verb: strings.ToLower(u.Host)}}
+	want := 2
+	switch request.verb {
+	case uriOpen, uriRead:
+	case uriSnooze:
+		request.snooze = defaultSnooze
+		if minutes := u.Query().Get("minutes"); minutes != "" {
+			m, err := strconv.Atoi(minutes)
+			if err != nil || m <= 0 {
+				return uriRequest{}, errors.New("invalid snooze minutes " + minutes)
+			}
+			request.snooze = time.Duration(m) * time.Minute
+		}
+	case uriLogin:
+		want = 1
+	default:
+		return uriRequest{}, errors.New("unknown action " + request.verb)
+	}
+	if len(segments) != want || segments[0] == "" || segments[want-1] == "" {
+		return uriRequest{}, fmt.Errorf("%s expects %d path segment(s): %s", request.verb, want, raw)
+	}
+
+	request.account = segments[0]
+	if want == 2 {
+		request.token = segments[1]
+	}
+	return request, nil
+}
+
+// Runs a gotalk:// URI, in the process running the monitors.
+func runURI(raw string) (string, error) {
+	request, err := parseURI(raw)
+	if err != nil {
+		return "", err
+	}
+	ref, err := findAccount(request.account)
+	if err != nil {
+		return "", err
+	}
+
+	switch request.verb {
+	case uriOpen:
+		target := strings.TrimRight(instanceURL(ref.instance), "/") + "/call/" + url.PathEscape(request.token)
+		if err := browser.OpenURL(target); err != nil {
+			return "", err
+		}
+		return "Opened " + target + ".", nil
+	case uriLogin:
+		if err := loginMonitor(ref.key(), nil); err != nil {
+			return "", err
+		}
+		return "Logging in to " + ref.key() + ".", nil
+	}
+
+	if err := queueMonitorAction(ref.key(), request.conversationAction); err != nil {
+		return "", err
+	}
+	if request.verb == uriSnooze {
+		return fmt.Sprintf("Snoozing the conversation for %s.", request.snooze), nil
+	}
+	return "Marking the conversation as read.", nil
+}
+
+// Runs the actions clicked in notifications, once logged in.
+func (p *monitorProcData) runPendingActions(ctx context.Context) {
+	for _, action := range p.pendingActions {
+		switch action.verb {
+		case uriRead:
+			if err := p.ncMonitor.MarkConversationRead(ctx, action.token); err != nil {
+				log.Print(err)
+			}
+		case uriSnooze:
+			p.ncMonitor.Snooze(action.token, time.Now().Add(action.snooze))
+		}
+	}
+	p.pendingActions = nil
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Quotes an argument of the Exec key of a desktop entry.
+func desktopQuote(arg string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`)
+	return `"` + r.Replace(arg) + `"`
+}
+
+// Registers GoTalk as the handler of gotalk:// URIs, through a desktop entry declaring the x-scheme-handler MIME type.
+// The notifications name the same entry, so the notification service shows the GoTalk name and icon.
+func registerURIScheme() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	dir := filepath.Join(dataHome, "applications")
+	path := filepath.Join(dir, "gotalk.desktop")
+
+	entry := []byte(`[Desktop Entry]
+Type=Application
+Name=GoTalk
+Comment=Nextcloud Talk notifications
+Exec=` + desktopQuote(executable) + ` %u
+Terminal=false
+NoDisplay=true
+MimeType=x-scheme-handler/` + uriScheme + `;
+`)
+
+	// Only rewritten when the executable moved.
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, entry) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, entry, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	// Without xdg-utils, the desktop environment still finds the MIME type in the entry.
+	if xdgMime, err := exec.LookPath("xdg-mime"); err == nil {
+		return exec.Command(xdgMime, "default", "gotalk.desktop", "x-scheme-handler/"+uriScheme).Run()
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// Registers GoTalk as the handler of gotalk:// URIs for the current user, under HKCU\Software\Classes.
+func registerURIScheme() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, `Software\Classes\`+uriScheme, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	if err := key.SetStringValue("", "URL:GoTalk"); err != nil {
+		return err
+	}
+	if err := key.SetStringValue("URL Protocol", ""); err != nil {
+		return err
+	}
+
+	command, _, err := registry.CreateKey(registry.CURRENT_USER, `Software\Classes\`+uriScheme+`\shell\open\command`, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer command.Close()
+	return command.SetStringValue("", `"`+executable+`" "%1"`)
+}
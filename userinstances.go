@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"GoTalk/nc"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Checks a URL against the organization policy for user-added instances.
+func (o *OrgSettings) checkUserInstance(instanceURL string) error {
+	switch o.UserInstances {
+	case UserInstancesAllowed:
+		return nil
+	case UserInstancesAllowlist:
+		u, err := url.Parse(instanceURL)
+		if err != nil {
+			return err
+		}
+		host := strings.ToLower(u.Hostname())
+		for _, domain := range o.UserInstanceDomains {
+			domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+			if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+				return nil
+			}
+		}
+		return errors.New("your organization doesn't allow adding " + host)
+	}
+	return errors.New("your organization doesn't allow adding instances")
+}
+
+// Settings of a user-added instance. The organization has no say on them besides the policy.
+func (u UserInstance) settings() OrgInstanceSettings {
+	return OrgInstanceSettings{
+		InstanceURL: u.InstanceURL,
+		Login:       LoginImmediately,
+	}
+}
+
+// Returns the settings of an instance, from the organization or added by the user.
+// User-added instances that the policy doesn't allow anymore are ignored.
+func instanceSettings(instance string) (OrgInstanceSettings, bool) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return instanceSettingsLocked(instance)
+}
+
+func instanceSettingsLocked(instance string) (OrgInstanceSettings, bool) {
+	if o, ok := org.InstanceData[instance]; ok {
+		return o, true
+	}
+	if u, ok := user.UserInstances[instance]; ok && org.checkUserInstance(u.InstanceURL) == nil {
+		return u.settings(), true
+	}
+	return OrgInstanceSettings{}, false
+}
+
+// Where an instance answers: the URL the user switched to after a move, or the configured one.
+// A moved instance is the same server for every account.
+func instanceURL(instance string) string {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	settings, _ := instanceSettingsLocked(instance)
+	return cmp.Or(user.InstanceData[instance].EffectiveInstanceURL, settings.InstanceURL)
+}
+
+// Finds the Nextcloud server at the given address, and checks it against the organization policy.
+func discoverUserInstance(ctx context.Context, address string) (string, error) {
+	typed := strings.TrimSpace(address)
+	if !strings.Contains(typed, "://") {
+		typed = "https://" + typed
+	}
+
+	settingsMutex.Lock()
+	policy := *org
+	settingsMutex.Unlock()
+
+	// Checked before contacting the server, then again on the discovered URL.
+	if err := policy.checkUserInstance(typed); err != nil {
+		return "", err
+	}
+
+	ncInstance := nc.NewInstance(typed, "")
+	instanceURL, err := ncInstance.DiscoverBaseURL(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	// Redirects may have led elsewhere.
+	if err := policy.checkUserInstance(instanceURL); err != nil {
+		return "", err
+	}
+	return instanceURL, nil
+}
+
+// Saves a discovered server as a user-added instance. The name defaults to the host of the server.
+func addUserInstance(name string, instanceURL string) (accountRef, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		u, _ := url.Parse(instanceURL)
+		name = u.Host
+	}
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	for existing := range org.InstanceData {
+		if existing == name {
+			return accountRef{}, errors.New("an instance is already named " + name)
+		}
+		if strings.EqualFold(org.InstanceData[existing].InstanceURL, instanceURL) {
+			return accountRef{}, errors.New("this server is already set up as " + existing + ": use Add Account... in its menu")
+		}
+	}
+	for existing, data := range user.UserInstances {
+		if existing == name || strings.EqualFold(data.InstanceURL, instanceURL) {
+			return accountRef{}, errors.New("this server is already set up as " + existing)
+		}
+	}
+	// The settings and the cache of an account, e.g. "Work (helpdesk)", must not be shared.
+	_, hasSettings := user.InstanceData[name]
+	_, hasCache := cache.InstanceData[name]
+	if hasSettings || hasCache {
+		return accountRef{}, errors.New("an account is already named " + name)
+	}
+
+	if user.UserInstances == nil {
+		user.UserInstances = make(map[string]UserInstance)
+	}
+	user.UserInstances[name] = UserInstance{InstanceURL: instanceURL}
+
+	ref := accountRef{instance: name}
+	initAccountSettings(ref)
+
+	if err := settingsManager.Save(cache, user, org); err != nil {
+		return accountRef{}, err
+	}
+	return ref, nil
+}
+
+// Asks for the address of a Nextcloud server to monitor, in addition to the ones of the organization.
+// Once the server is found and saved, onAdd starts monitoring it, which starts the login flow.
+func showAddInstanceWindow(onAdd func(accountRef)) {
+	window := fyne.CurrentApp().NewWindow("Add Account")
+
+	address := widget.NewEntry()
+	address.SetPlaceHolder("cloud.example.org")
+
+	name := widget.NewEntry()
+	name.SetPlaceHolder("Optional, defaults to the server name")
+
+	hint := widget.NewLabel("Enter the address of the Nextcloud server, as shown in the browser. Your browser opens to log in once the server is found.")
+	hint.Wrapping = fyne.TextWrapWord
+
+	status := widget.NewLabel("")
+	status.Wrapping = fyne.TextWrapWord
+
+	var form *widget.Form
+	form = &widget.Form{
+		Items: []*widget.FormItem{
+			widget.NewFormItem("Server address", address),
+			widget.NewFormItem("Name", name),
+		},
+		SubmitText: "Add",
+		CancelText: "Cancel",
+		OnCancel:   window.Close,
+		OnSubmit: func() {
+			form.Disable()
+			status.SetText("Looking for the Nextcloud server...")
+
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+
+				instanceURL, err := discoverUserInstance(ctx, address.Text)
+				if err != nil {
+					if errors.Is(err, nc.ErrNotNextcloud) {
+						status.SetText("No Nextcloud server was found at this address.")
+					} else {
+						status.SetText(err.Error())
+					}
+					form.Enable()
+					return
+				}
+
+				// Saved under settingsMutex, while the monitors may be reading the settings.
+				ref, err := addUserInstance(name.Text, instanceURL)
+				if err != nil {
+					status.SetText(err.Error())
+					form.Enable()
+					return
+				}
+
+				window.Close()
+				onAdd(ref)
+			}()
+		},
+	}
+
+	window.SetContent(container.NewVBox(hint, form, status))
+	window.Resize(fyne.NewSize(460, 0))
+	window.CenterOnScreen()
+	window.Show()
+}
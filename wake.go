@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// How often the wall clock is compared to the monotonic clock
+	wakeCheckInterval = time.Second * 15
+	// A wall clock jump larger than this means the machine was asleep, or its clock was changed
+	wakeJumpThreshold = time.Second * 30
+)
+
+// The monotonic clock stops while the machine is asleep, and so do the timers of the monitors:
+// without this, a laptop waking up would wait for the remainder of the last backoff before checking again.
+// Both explicit resume events and wall clock jumps trigger an immediate check on every monitor.
+func startWakeDetection(closeChan chan interface{}) {
+	if err := watchResumeEvents(closeChan, retryAllMonitors); err != nil {
+		log.Print(err)
+	}
+
+	go watchClockJumps(closeChan, retryAllMonitors)
+}
+
+func watchClockJumps(closeChan chan interface{}, onWake func()) {
+	ticker := time.NewTicker(wakeCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			monotonic := now.Sub(last)
+			wall := now.Round(0).Sub(last.Round(0))
+			last = now
+
+			if drift := wall - monotonic; drift > wakeJumpThreshold || drift < -wakeJumpThreshold {
+				onWake()
+			}
+		case <-closeChan:
+			return
+		}
+	}
+}